@@ -0,0 +1,180 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+var ErrUnknownCodec = errors.New("ipcmsg: unknown codec")
+
+// CodecID identifies a codec on the wire so the receiving end decodes a
+// payload with the codec it was encoded with.
+type CodecID uint8
+
+const (
+	IPCMSG_CODEC_GOB CodecID = iota
+	IPCMSG_CODEC_JSON
+	IPCMSG_CODEC_RAW
+	IPCMSG_CODEC_BINARY
+)
+
+// Codec turns message payloads into bytes and back.
+type Codec interface {
+	ID() CodecID
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	muCodecs sync.RWMutex
+	codecs   = make(map[CodecID]Codec)
+
+	muTypeCodecs sync.RWMutex
+	typeCodecs   = make(map[IPCMsgType]Codec)
+)
+
+func init() {
+	RegisterCodec(GobCodec{})
+	RegisterCodec(JSONCodec{})
+	RegisterCodec(RawCodec{})
+	RegisterCodec(BinaryCodec{})
+}
+
+// RegisterCodec makes a codec available to decode received messages,
+// both ends need to register it under the same ID.
+func RegisterCodec(codec Codec) {
+	muCodecs.Lock()
+	defer muCodecs.Unlock()
+	if _, exists := codecs[codec.ID()]; exists {
+		panic(fmt.Sprintf("codec %d registered twice", codec.ID()))
+	}
+	codecs[codec.ID()] = codec
+}
+
+func lookupCodec(id CodecID) (Codec, error) {
+	muCodecs.RLock()
+	defer muCodecs.RUnlock()
+	codec, exists := codecs[id]
+	if !exists {
+		return nil, fmt.Errorf("%w %d", ErrUnknownCodec, id)
+	}
+	return codec, nil
+}
+
+// SetTypeCodec selects the codec used for msgtype payloads, whatever the
+// codec of the channel they are sent on.
+func SetTypeCodec(msgtype IPCMsgType, codec Codec) {
+	muTypeCodecs.Lock()
+	defer muTypeCodecs.Unlock()
+	typeCodecs[msgtype] = codec
+}
+
+// GobCodec is the default codec, it handles any Go value but re-sends
+// type descriptors with every message. what it decodes is bounded by the
+// maximum decode size of the channel, see Channel.SetMaxDecodeSize().
+type GobCodec struct{}
+
+func (GobCodec) ID() CodecID {
+	return IPCMSG_CODEC_GOB
+}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSONCodec produces payloads readable by non-Go tools.
+type JSONCodec struct{}
+
+func (JSONCodec) ID() CodecID {
+	return IPCMSG_CODEC_JSON
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// RawCodec passes []byte payloads through untouched.
+type RawCodec struct{}
+
+func (RawCodec) ID() CodecID {
+	return IPCMSG_CODEC_RAW
+}
+
+func (RawCodec) Marshal(v interface{}) ([]byte, error) {
+	switch data := v.(type) {
+	case []byte:
+		return data, nil
+	case *[]byte:
+		return *data, nil
+	}
+	return nil, fmt.Errorf("raw codec: can't marshal %T", v)
+}
+
+func (RawCodec) Unmarshal(data []byte, v interface{}) error {
+	ptr, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("raw codec: can't unmarshal into %T", v)
+	}
+	*ptr = append([]byte(nil), data...)
+	return nil
+}
+
+// BinaryCodec is a compact encoding for fixed-size values, such as numbers
+// and structs made of them, as understood by encoding/binary.
+type BinaryCodec struct{}
+
+func (BinaryCodec) ID() CodecID {
+	return IPCMSG_CODEC_BINARY
+}
+
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	reader := bytes.NewReader(data)
+	if err := binary.Read(reader, binary.BigEndian, v); err != nil {
+		return err
+	}
+	if reader.Len() != 0 {
+		return fmt.Errorf("binary codec: %d trailing bytes", reader.Len())
+	}
+	return nil
+}
@@ -0,0 +1,334 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+)
+
+type DispatchMode int
+
+const (
+	// handlers run one at a time, in the order messages were received,
+	// except that while a handler waits on IPCMessage.Query() the next
+	// messages are handled, so it resumes alongside their handlers
+	IPCMSG_DISPATCH_SERIAL DispatchMode = iota
+	// handlers run concurrently on a pool of workers, in no particular order
+	IPCMSG_DISPATCH_POOL
+	// messages sharing a key are handled in order, one at a time, while
+	// messages with different keys are handled concurrently
+	IPCMSG_DISPATCH_KEYED
+)
+
+// default number of handlers running at once in the concurrent dispatch modes
+const IPCMSG_DISPATCH_WORKERS = 8
+
+// default number of messages taken in by Dispatch() and not yet handled in the
+// concurrent dispatch modes, beyond which it stops taking them in
+const IPCMSG_MAX_IN_FLIGHT = 64
+
+// DispatchConfig selects how Dispatch() runs handlers, see SetDispatch().
+type DispatchConfig struct {
+	Mode DispatchMode
+
+	// handlers running at once, IPCMSG_DISPATCH_WORKERS if left to zero
+	Workers int
+
+	// messages taken in and not yet handled, IPCMSG_MAX_IN_FLIGHT if left
+	// to zero. once reached and IPCMSG_MAX_QUEUED more are queued, the peer
+	// is not read from until one is handled, so that a peer sending faster
+	// than we handle ends up blocked
+	MaxInFlight int
+
+	// the key of a message in IPCMSG_DISPATCH_KEYED mode, such as a session
+	// it belongs to. keys must be comparable, the message type is the key if
+	// left to nil
+	Key func(*IPCMessage) interface{}
+}
+
+// SetDispatch selects how Dispatch() runs handlers, it must be called before
+// Dispatch(). in the concurrent modes, a handler querying the peer must not
+// expect a message with the same key as its own to be handled meanwhile.
+func (channel *Channel) SetDispatch(config DispatchConfig) {
+	if config.Workers <= 0 {
+		config.Workers = IPCMSG_DISPATCH_WORKERS
+	}
+	if config.MaxInFlight <= 0 {
+		config.MaxInFlight = IPCMSG_MAX_IN_FLIGHT
+	}
+	if config.Key == nil {
+		config.Key = func(msg *IPCMessage) interface{} {
+			return msg.hdr.Type
+		}
+	}
+
+	channel.muDispatch.Lock()
+	defer channel.muDispatch.Unlock()
+	channel.dispatchConfig = config
+}
+
+// Dispatch calls the handlers of received messages until the channel goes
+// down, in order and one at a time unless SetDispatch() says otherwise. a
+// handler may query the peer with IPCMessage.Query(): while it waits for the
+// reply, the next messages are dispatched as the peer may need one of them
+// handled before it replies. queries made by other means don't affect
+// dispatching, their reply gets through as long as fewer than
+// IPCMSG_MAX_QUEUED messages are waiting to be handled.
+//
+// the returned channel receives true once dispatching stopped and is closed
+// afterwards, calling Dispatch() again starts nothing and returns it as well.
+func (channel *Channel) Dispatch() <-chan bool {
+	channel.muDispatch.Lock()
+	if done := channel.dispatchDone; done != nil {
+		channel.muDispatch.Unlock()
+		return done
+	}
+	done := make(chan bool, 1)
+	channel.dispatchGen++
+	gen := channel.dispatchGen
+	channel.dispatchDone = done
+	config := channel.dispatchConfig
+	channel.workersLimit = config.Workers
+	channel.muDispatch.Unlock()
+
+	switch config.Mode {
+	case IPCMSG_DISPATCH_POOL, IPCMSG_DISPATCH_KEYED:
+		go channel.dispatchConcurrent(config, done)
+	default:
+		go channel.dispatch(gen, done)
+	}
+	return done
+}
+
+// dispatchEnded lets everyone waiting on Dispatch() know it stopped.
+func dispatchEnded(done chan bool) {
+	done <- true
+	close(done)
+}
+
+// nextHandler waits for the next message to handle, ok is false once the
+// channel is down.
+func (channel *Channel) nextHandler() (msg *IPCMessage, handler func(*IPCMessage), ok bool) {
+	for {
+		// messages taken in before the channel went down are handled,
+		// the reader closes the queue once it is gone
+		msg, ok = <-channel.r
+		if !ok {
+			return nil, nil, false
+		}
+
+		if msg.hdr.Type == IPCMSG_PING {
+			channel.ping(msg)
+			continue
+		}
+
+		channel.muHandlers.Lock()
+		handler, exists := channel.handlers[msg.hdr.Type]
+		channel.muHandlers.Unlock()
+		if !exists && channel.server != nil {
+			handler, exists = channel.server.handler(msg.hdr.Type)
+		}
+		if !exists {
+			closeFds(msg.fds)
+			channel.fail(channel.errorf("%w %d", ErrUnexpectedType, msg.hdr.Type))
+			return nil, nil, false
+		}
+		return msg, handler, true
+	}
+}
+
+// dispatch is the serial dispatching loop, it steps down if another one took
+// over while a handler was waiting for a reply.
+func (channel *Channel) dispatch(gen uint64, done chan bool) {
+	for {
+		msg, handler, ok := channel.nextHandler()
+		if !ok {
+			dispatchEnded(done)
+			return
+		}
+
+		channel.callHandler(handler, msg, func() func() {
+			channel.muDispatch.Lock()
+			defer channel.muDispatch.Unlock()
+			if channel.dispatchGen == gen {
+				channel.dispatchGen++
+				go channel.dispatch(channel.dispatchGen, channel.dispatchDone)
+			}
+			return func() {}
+		})
+
+		channel.muDispatch.Lock()
+		leading := channel.dispatchGen == gen
+		channel.muDispatch.Unlock()
+		if !leading {
+			return
+		}
+	}
+}
+
+type dispatchJob struct {
+	msg     *IPCMessage
+	handler func(*IPCMessage)
+}
+
+// dispatchConcurrent is the dispatching loop of the pool and keyed modes.
+func (channel *Channel) dispatchConcurrent(config DispatchConfig, done chan bool) {
+	inFlight := make(chan struct{}, config.MaxInFlight)
+
+	// jobs waiting for their key, a key is in there while it is being handled
+	var muKeys sync.Mutex
+	keys := make(map[interface{}][]dispatchJob)
+
+	drain := func(key interface{}) {
+		for {
+			muKeys.Lock()
+			jobs := keys[key]
+			if len(jobs) == 0 {
+				delete(keys, key)
+				muKeys.Unlock()
+				return
+			}
+			job := jobs[0]
+			keys[key] = jobs[1:]
+			muKeys.Unlock()
+
+			channel.runWorker(job.handler, job.msg)
+			<-inFlight
+		}
+	}
+
+	for {
+		select {
+		case inFlight <- struct{}{}:
+		case <-channel.failed:
+			channel.drainQueue()
+			dispatchEnded(done)
+			return
+		}
+
+		msg, handler, ok := channel.nextHandler()
+		if !ok {
+			dispatchEnded(done)
+			return
+		}
+
+		if config.Mode == IPCMSG_DISPATCH_POOL {
+			go func() {
+				channel.runWorker(handler, msg)
+				<-inFlight
+			}()
+			continue
+		}
+
+		key := config.Key(msg)
+		muKeys.Lock()
+		jobs, busy := keys[key]
+		keys[key] = append(jobs, dispatchJob{msg: msg, handler: handler})
+		muKeys.Unlock()
+		if !busy {
+			go drain(key)
+		}
+	}
+}
+
+// drainQueue drops the messages left queued once the channel is down.
+func (channel *Channel) drainQueue() {
+	for msg := range channel.r {
+		closeFds(msg.fds)
+	}
+}
+
+// runWorker calls handler once a worker is available.
+func (channel *Channel) runWorker(handler func(*IPCMessage), msg *IPCMessage) {
+	channel.muDispatch.Lock()
+	for channel.workersBusy >= channel.workersLimit {
+		channel.workers.Wait()
+	}
+	channel.workersBusy++
+	channel.muDispatch.Unlock()
+
+	channel.callHandler(handler, msg, func() func() {
+		channel.muDispatch.Lock()
+		defer channel.muDispatch.Unlock()
+		channel.workersLimit++
+		channel.workers.Signal()
+		return func() {
+			channel.muDispatch.Lock()
+			defer channel.muDispatch.Unlock()
+			channel.workersLimit--
+		}
+	})
+
+	channel.muDispatch.Lock()
+	channel.workersBusy--
+	channel.workers.Signal()
+	channel.muDispatch.Unlock()
+}
+
+// yieldDispatch is called by queries made from the handler of msg about to
+// wait for their reply, which may depend on the next messages being handled:
+// the serial loop is handed over to a new one and, in the concurrent modes,
+// one more worker is allowed until the returned function is called.
+func (msg *IPCMessage) yieldDispatch() func() {
+	if msg.yield == nil || atomic.LoadInt32(&msg.handled) != 0 {
+		return func() {}
+	}
+	return msg.yield()
+}
+
+// PanicError reports a panic recovered from a handler to the OnError hook.
+type PanicError struct {
+	Type  IPCMsgType
+	Value interface{}
+	Stack []byte
+}
+
+func (err *PanicError) Error() string {
+	return fmt.Sprintf("%v handler panicked: %v\n%s", err.Type, err.Value, err.Stack)
+}
+
+func (err *PanicError) Unwrap() error {
+	return ErrHandlerPanic
+}
+
+// callHandler runs handler on msg, yield hands dispatching over while it waits
+// on a query. a panic doesn't take the process down, it is reported and the
+// peer gets an error reply if it waits for one.
+func (channel *Channel) callHandler(handler func(*IPCMessage), msg *IPCMessage, yield func() func()) {
+	msg.yield = yield
+	defer atomic.StoreInt32(&msg.handled, 1)
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		channel.report(channel.errorf("%w", &PanicError{Type: msg.hdr.Type, Value: r, Stack: debug.Stack()}))
+		if msg.hdr.Kind == IPCMSG_KIND_REQUEST && atomic.LoadInt32(&msg.replied) == 0 {
+			msg.ReplyError(fmt.Errorf("%v: %w", msg.hdr.Type, ErrHandlerPanic))
+		}
+	}()
+
+	handler(msg)
+
+	// the peer would wait forever otherwise
+	if msg.hdr.Kind == IPCMSG_KIND_REQUEST && atomic.LoadInt32(&msg.replied) == 0 {
+		msg.ReplyError(fmt.Errorf("%v: %w", msg.hdr.Type, ErrNoReply))
+	}
+}
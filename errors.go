@@ -0,0 +1,114 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"syscall"
+)
+
+// codes of the well-known errors a RemoteError may stand for,
+// applications pick theirs from IPCMSG_ERR_USER up, see ErrorCoder
+const (
+	IPCMSG_ERR_UNKNOWN = iota
+	IPCMSG_ERR_NOT_EXIST
+	IPCMSG_ERR_EXIST
+	IPCMSG_ERR_PERMISSION
+	IPCMSG_ERR_INVALID
+	IPCMSG_ERR_DEADLINE
+	IPCMSG_ERR_CANCELED
+	IPCMSG_ERR_NO_REPLY
+	IPCMSG_ERR_PANIC
+
+	IPCMSG_ERR_USER = 1000
+)
+
+var wellKnownErrors = []struct {
+	code int
+	err  error
+}{
+	{IPCMSG_ERR_NOT_EXIST, fs.ErrNotExist},
+	{IPCMSG_ERR_EXIST, fs.ErrExist},
+	{IPCMSG_ERR_PERMISSION, fs.ErrPermission},
+	{IPCMSG_ERR_INVALID, fs.ErrInvalid},
+	{IPCMSG_ERR_DEADLINE, context.DeadlineExceeded},
+	{IPCMSG_ERR_CANCELED, context.Canceled},
+	{IPCMSG_ERR_NO_REPLY, ErrNoReply},
+	{IPCMSG_ERR_PANIC, ErrHandlerPanic},
+}
+
+// ErrorCoder is implemented by errors carrying an application defined code,
+// which is passed along when they are replied to a query.
+type ErrorCoder interface {
+	ErrorCode() int
+}
+
+// RemoteError is what a query fails with when the peer replies with an error.
+// errors.Is() matches it against the well-known error it stands for, if any,
+// as well as against its errno.
+type RemoteError struct {
+	Message string
+	Code    int
+
+	// set if the error on the peer side was, or wrapped, a syscall.Errno
+	Errno syscall.Errno
+}
+
+func newRemoteError(err error) RemoteError {
+	remote := RemoteError{Message: err.Error()}
+	for _, known := range wellKnownErrors {
+		if errors.Is(err, known.err) {
+			remote.Code = known.code
+			break
+		}
+	}
+	var coder ErrorCoder
+	if errors.As(err, &coder) {
+		remote.Code = coder.ErrorCode()
+	}
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		remote.Errno = errno
+	}
+	return remote
+}
+
+func (err *RemoteError) Error() string {
+	return "peer: " + err.Message
+}
+
+func (err *RemoteError) ErrorCode() int {
+	return err.Code
+}
+
+func (err *RemoteError) Is(target error) bool {
+	for _, known := range wellKnownErrors {
+		if err.Code == known.code && target == known.err {
+			return true
+		}
+	}
+	return false
+}
+
+func (err *RemoteError) Unwrap() error {
+	if err.Errno == 0 {
+		return nil
+	}
+	return err.Errno
+}
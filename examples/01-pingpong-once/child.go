@@ -18,13 +18,16 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"log"
 
 	"github.com/poolpOrg/go-ipcmsg"
 )
 
 func child() {
-	channel := ipcmsg.NewChannel("child<->parent", os.Getppid(), 3)
+	channel, err := ipcmsg.ChildChannel()
+	if err != nil {
+		log.Fatal(err)
+	}
 	channel.Handler(IPCMSG_PING, handlePING)
 	<-channel.Dispatch() // Run() and wait until it returns
 }
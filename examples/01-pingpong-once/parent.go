@@ -18,17 +18,24 @@ package main
 
 import (
 	"fmt"
+	"log"
 
 	"github.com/poolpOrg/go-ipcmsg"
 )
 
 func parent() {
-	pid, fd := fork_child()
-	channel := ipcmsg.NewChannel("parent<->child", pid, fd)
+	channel, _, err := ipcmsg.Spawn("child")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer channel.Close()
 	channel.Dispatch()
 
 	var data string
-	response := channel.Query(IPCMSG_PING, "PING ?", -1)
+	response, err := channel.Query(IPCMSG_PING, "PING ?", -1)
+	if err != nil {
+		log.Fatal(err)
+	}
 	response.Unmarshal(&data)
 
 	fmt.Printf("parent: got response from child: %s\n", data)
@@ -18,13 +18,16 @@ package main
 
 import (
 	"fmt"
-	"os"
+	"log"
 
 	"github.com/poolpOrg/go-ipcmsg"
 )
 
 func child() {
-	channel := ipcmsg.NewChannel("child<->parent", os.Getppid(), 3)
+	channel, err := ipcmsg.ChildChannel()
+	if err != nil {
+		log.Fatal(err)
+	}
 	channel.Handler(IPCMSG_PING, handlePING)
 	<-channel.Dispatch()
 }
@@ -34,5 +37,5 @@ func handlePING(msg *ipcmsg.IPCMessage) {
 	msg.Unmarshal(&data)
 
 	fmt.Printf("child: got PING from parent: %s\n", data)
-	msg.Reply(IPCMSG_PONG, "PONG !", -1)
+	msg.Channel().Message(IPCMSG_PONG, "PONG !", -1)
 }
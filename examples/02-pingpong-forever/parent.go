@@ -18,13 +18,16 @@ package main
 
 import (
 	"fmt"
+	"log"
 
 	"github.com/poolpOrg/go-ipcmsg"
 )
 
 func parent() {
-	pid, fd := fork_child()
-	channel := ipcmsg.NewChannel("parent<->child", pid, fd)
+	channel, _, err := ipcmsg.Spawn("child")
+	if err != nil {
+		log.Fatal(err)
+	}
 	channel.Handler(IPCMSG_PONG, handlePONG)
 	channel.Message(IPCMSG_PING, "PING ?", -1)
 	<-channel.Dispatch()
@@ -35,5 +38,5 @@ func handlePONG(msg *ipcmsg.IPCMessage) {
 	msg.Unmarshal(&data)
 
 	fmt.Printf("parent: got PONG from child: %s\n", data)
-	msg.Reply(IPCMSG_PING, "PING !", -1)
+	msg.Channel().Message(IPCMSG_PING, "PING !", -1)
 }
@@ -17,23 +17,37 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"io/fs"
+	"log"
 	"syscall"
 
 	"github.com/poolpOrg/go-ipcmsg"
 )
 
 func child() {
-	channel := ipcmsg.NewChannel("child<->parent", os.Getppid(), 3)
+	channel, err := ipcmsg.ChildChannel()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer channel.Close()
 	channel.Dispatch()
 
 	var data string
-	response := channel.Query(IPCMSG_OPENFILE, "/etc/passwd", -1)
+	response, err := channel.Query(IPCMSG_OPENFILE, "/etc/passwd", -1)
+	if err != nil {
+		log.Fatal(err)
+	}
 	response.Unmarshal(&data)
 
 	fmt.Println("child received: ", response.Type(), data, response.Fd())
 	if response.Fd() != -1 {
 		syscall.Close(response.Fd())
 	}
+
+	_, err = channel.Query(IPCMSG_OPENFILE, "/nonexistent", -1)
+	if errors.Is(err, fs.ErrNotExist) {
+		fmt.Println("child received: ", err)
+	}
 }
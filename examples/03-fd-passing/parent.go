@@ -18,27 +18,29 @@ package main
 
 import (
 	"fmt"
+	"log"
 	"os"
 
 	"github.com/poolpOrg/go-ipcmsg"
 )
 
 func parent() {
-	pid, fd := fork_child()
-	channel := ipcmsg.NewChannel("parent<->child", pid, fd)
-	channel.Handler(IPCMSG_OPENFILE, handleOPENFILE)
+	channel, _, err := ipcmsg.Spawn("child")
+	if err != nil {
+		log.Fatal(err)
+	}
+	channel.QueryHandler(IPCMSG_OPENFILE, IPCMSG_OPENFILE, handleOPENFILE)
 	<-channel.Dispatch()
 }
 
-func handleOPENFILE(msg *ipcmsg.IPCMessage) {
+func handleOPENFILE(msg *ipcmsg.IPCMessage) (interface{}, int, error) {
 	var data string
 	msg.Unmarshal(&data)
 	fmt.Printf("parent: got IPCMSG_OPENFILE from child: %s\n", data)
 
 	fp, err := os.Open(data)
 	if err != nil {
-		msg.Reply(IPCMSG_OPENFILE, "NOPE !", -1)
-	} else {
-		msg.Reply(IPCMSG_OPENFILE, "OK !", int(fp.Fd()))
+		return nil, -1, err
 	}
+	return "OK !", int(fp.Fd()), nil
 }
@@ -17,11 +17,6 @@
 package main
 
 import (
-	"log"
-	"os"
-	"os/exec"
-	"syscall"
-
 	"github.com/poolpOrg/go-ipcmsg"
 )
 
@@ -29,58 +24,14 @@ var (
 	IPCMSG_OPENFILE ipcmsg.IPCMsgType = ipcmsg.NewIPCMsgType("")
 )
 
-// upon execution, call parent() which will setup a socketpair
-// then fork a child to reexec the program with the REEXEC env
-// var set to CHILD, making it execute child().
+// upon execution, call parent() which will spawn a child
+// reexecuting the program in the "child" role, making it
+// execute child().
 func main() {
-	reexec := os.Getenv("REEXEC")
-	switch reexec {
+	switch ipcmsg.Role() {
 	case "":
 		parent()
-	case "CHILD":
+	case "child":
 		child()
 	}
 }
-
-// fork_child() sets up the socketpair to be shared by parent and child,
-// passing one end as fd 3 to child & returning the other end to parent.
-// the child reexecutes the program with env var REEXEC.
-func fork_child() (int, int) {
-	binary, err := exec.LookPath(os.Args[0])
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	sp, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_STREAM, syscall.AF_UNSPEC)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// XXX - not quite there yet
-	//syscall.SetNonblock(sp[0], true)
-	//syscall.SetNonblock(sp[1], true)
-
-	procAttr := syscall.ProcAttr{}
-	procAttr.Files = []uintptr{
-		uintptr(syscall.Stdin),
-		uintptr(syscall.Stdout),
-		uintptr(syscall.Stderr),
-		uintptr(sp[0]),
-	}
-	procAttr.Env = []string{
-		"REEXEC=CHILD",
-	}
-
-	var pid int
-
-	pid, err = syscall.ForkExec(binary, []string{os.Args[0]}, &procAttr)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	if syscall.Close(sp[0]) != nil {
-		log.Fatal(err)
-	}
-
-	return pid, sp[1]
-}
@@ -25,8 +25,10 @@ import (
 )
 
 func parent() {
-	pid, fd := fork_child()
-	channel := ipcmsg.NewChannel("parent<->child", pid, fd)
+	channel, _, err := ipcmsg.Spawn("child")
+	if err != nil {
+		log.Fatal(err)
+	}
 	channel.Handler(IPCMSG_PONG, handlePONG)
 
 	fp, err := os.Open("/etc/passwd")
@@ -42,5 +44,5 @@ func handlePONG(msg *ipcmsg.IPCMessage) {
 	msg.Unmarshal(&data)
 
 	fmt.Printf("parent: got PONG with fd=%d from child: %s\n", msg.Fd(), data)
-	msg.Reply(IPCMSG_PING, "PING !", msg.Fd())
+	msg.Channel().Message(IPCMSG_PING, "PING !", msg.Fd())
 }
@@ -0,0 +1,191 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// pendingFd is a received FD waiting for its message, it came along
+// the read which covered stream offsets [start, end).
+type pendingFd struct {
+	fd    int
+	start uint64
+	end   uint64
+}
+
+// inbuf accumulates what is read from a stream socket across reads,
+// so that messages straddling reads are only emitted once complete.
+//
+// on a stream socket the kernel hands over an FD with the read that
+// covers the first byte of the sendmsg that carried it, which is the
+// first byte of the header of its message. keeping track of the range
+// each FD was read with is enough to tell which message it belongs to.
+type inbuf struct {
+	buf    []byte
+	offset uint64 // stream offset of buf[0]
+	fds    []pendingFd
+}
+
+func (in *inbuf) append(data []byte, fds []int) {
+	start := in.offset + uint64(len(in.buf))
+	end := start + uint64(len(data))
+	for _, fd := range fds {
+		in.fds = append(in.fds, pendingFd{fd: fd, start: start, end: end})
+	}
+	in.buf = append(in.buf, data...)
+}
+
+// next extracts the next complete message from the buffer,
+// it returns nil if more data needs to be read first.
+func (in *inbuf) next(maxSize int, maxFds int) (*IPCMessage, error) {
+	if len(in.buf) < IPCMSG_HEADER_SIZE {
+		return nil, nil
+	}
+
+	hdr, err := decodeHeader(in.buf[:IPCMSG_HEADER_SIZE])
+	if err != nil {
+		return nil, err
+	}
+
+	// don't wait for a message we're not going to accept anyways
+	if err := validateHeader(&hdr, maxSize, maxFds); err != nil {
+		return nil, err
+	}
+
+	size := IPCMSG_HEADER_SIZE + int(hdr.Size)
+	if len(in.buf) < size {
+		return nil, nil
+	}
+
+	msg := &IPCMessage{}
+	msg.hdr = hdr
+	msg.data = append([]byte(nil), in.buf[IPCMSG_HEADER_SIZE:size]...)
+	if msg.hdr.NumFds != 0 {
+		msg.fds = in.takeFds(in.offset, int(msg.hdr.NumFds))
+	}
+
+	// discard consumed data from input buffer
+	in.buf = in.buf[size:]
+	in.offset += uint64(size)
+	if len(in.buf) == 0 {
+		in.buf = nil
+	}
+
+	// FDs read entirely before the current offset belong to messages
+	// that didn't claim them, they would leak otherwise
+	for len(in.fds) > 0 && in.fds[0].end <= in.offset {
+		closeFd(in.fds[0].fd)
+		in.fds = in.fds[1:]
+	}
+
+	return msg, nil
+}
+
+// takeFds returns the n FDs that came along the message at offset,
+// -1 for each one that was lost, FD exhaustion on receiving end most-likely.
+func (in *inbuf) takeFds(offset uint64, n int) []int {
+	for len(in.fds) > 0 && in.fds[0].end <= offset {
+		closeFd(in.fds[0].fd)
+		in.fds = in.fds[1:]
+	}
+	fds := make([]int, n)
+	for i := range fds {
+		fds[i] = -1
+		if len(in.fds) != 0 && in.fds[0].start <= offset {
+			fds[i] = in.fds[0].fd
+			in.fds = in.fds[1:]
+		}
+	}
+	return fds
+}
+
+// pendingFds returns how many received FDs wait for their message.
+func (in *inbuf) pendingFds() int {
+	return len(in.fds)
+}
+
+// pending reports whether a partial message is buffered.
+func (in *inbuf) pending() bool {
+	return len(in.buf) != 0
+}
+
+// reset drops buffered data and closes FDs nobody claimed.
+func (in *inbuf) reset() {
+	for _, pfd := range in.fds {
+		closeFd(pfd.fd)
+	}
+	in.fds = nil
+	in.buf = nil
+}
+
+// decodePacket extracts the message held in a record read from a seqpacket or
+// datagram socket, along with the FDs it carries. FDs are closed on error.
+func decodePacket(buf []byte, fds []int, maxSize int, maxFds int) (*IPCMessage, error) {
+	var in inbuf
+	in.append(buf, fds)
+	defer in.reset()
+
+	msg, err := in.next(maxSize, maxFds)
+	if err != nil {
+		return nil, err
+	}
+	if msg == nil {
+		return nil, ErrShortMessage
+	}
+	if in.pending() {
+		closeFds(msg.fds)
+		return nil, ErrMalformedMessage
+	}
+	return msg, nil
+}
+
+// validateHeader checks a header received from the peer, which is not trusted,
+// before anything is allocated or waited for on its behalf.
+func validateHeader(hdr *ipcMsgHdr, maxSize int, maxFds int) error {
+	if uint64(hdr.Size) > uint64(maxSize) {
+		return fmt.Errorf("%d bytes: %w", hdr.Size, ErrMessageTooLarge)
+	}
+	if int(hdr.NumFds) > maxFds {
+		return fmt.Errorf("%d fds: %w", hdr.NumFds, ErrTooManyFds)
+	}
+	if hdr.Kind > IPCMSG_KIND_ERROR {
+		return fmt.Errorf("kind %v: %w", hdr.Kind, ErrMalformedMessage)
+	}
+	if _, err := lookupCodec(hdr.Codec); err != nil {
+		return fmt.Errorf("%v: %w", err, ErrMalformedMessage)
+	}
+	return nil
+}
+
+// encodeMessage packs msg header and msg data into a frame.
+func encodeMessage(msg *IPCMessage) ([]byte, error) {
+	var packed bytes.Buffer
+	if err := binary.Write(&packed, binary.BigEndian, &msg.hdr); err != nil {
+		return nil, err
+	}
+	packed.Write(msg.data)
+	return packed.Bytes(), nil
+}
+
+func decodeHeader(buf []byte) (ipcMsgHdr, error) {
+	var hdr ipcMsgHdr
+	err := binary.Read(bytes.NewReader(buf), binary.BigEndian, &hdr)
+	return hdr, err
+}
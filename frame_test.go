@@ -0,0 +1,145 @@
+package ipcmsg
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func testFrame(t testing.TB, data string, numFds int) []byte {
+	msg, err := createMessage(GobCodec{}, testMsgPing, data, make([]int, numFds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := encodeMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return frame
+}
+
+func FuzzInbuf(f *testing.F) {
+	f.Add(testFrame(f, "PING", 0), uint8(1), uint64(0))
+	f.Add(append(testFrame(f, "PING", 1), testFrame(f, "PONG", 0)...), uint8(7), uint64(1))
+	f.Add(append(testFrame(f, "PING", 2), testFrame(f, "PONG", 1)...), uint8(12), uint64(0x15))
+	f.Add(testFrame(f, string(make([]byte, 300)), 2), uint8(0), uint64(3))
+
+	f.Fuzz(func(t *testing.T, stream []byte, chunk uint8, withFds uint64) {
+		const maxSize, maxFds = 1024, 4
+
+		// the stream range each FD was read with, the
+		// i-th read carries one when bit i of withFds is set
+		type fdRange struct{ start, end uint64 }
+		sent := make(map[int]fdRange)
+		received := make(map[int]bool)
+		defer func() {
+			for fd := range received {
+				syscall.Close(fd)
+			}
+		}()
+
+		var in inbuf
+		defer in.reset()
+
+		var offset, consumed uint64
+		step := int(chunk) + 1
+		for i := 0; len(stream) != 0; i++ {
+			n := step
+			if n > len(stream) {
+				n = len(stream)
+			}
+			var fds []int
+			if withFds&(1<<(i%64)) != 0 {
+				fd, err := syscall.Dup(0)
+				if err != nil {
+					t.Fatal(err)
+				}
+				sent[fd] = fdRange{offset, offset + uint64(n)}
+				fds = append(fds, fd)
+			}
+			in.append(stream[:n], fds)
+			stream = stream[n:]
+			offset += uint64(n)
+
+			for {
+				msg, err := in.next(maxSize, maxFds)
+				if err != nil {
+					return
+				}
+				if msg == nil {
+					break
+				}
+				if len(msg.data) != int(msg.hdr.Size) || len(msg.data) > maxSize {
+					t.Fatalf("payload of %d bytes for a %d bytes header", len(msg.data), msg.hdr.Size)
+				}
+				if len(msg.fds) != int(msg.hdr.NumFds) || len(msg.fds) > maxFds {
+					t.Fatalf("%d fds for a header announcing %d", len(msg.fds), msg.hdr.NumFds)
+				}
+				for _, fd := range msg.fds {
+					if fd == -1 {
+						continue
+					}
+					r, exists := sent[fd]
+					if !exists || received[fd] {
+						t.Fatalf("fd %d out of thin air", fd)
+					}
+					received[fd] = true
+					if r.start > consumed || r.end <= consumed {
+						t.Fatalf("fd read with [%d, %d) handed to the message at %d", r.start, r.end, consumed)
+					}
+				}
+				consumed += uint64(IPCMSG_HEADER_SIZE + len(msg.data))
+				var v interface{}
+				msg.TryUnmarshal(&v)
+			}
+		}
+	})
+}
+
+func FuzzDecodePacket(f *testing.F) {
+	f.Add(testFrame(f, "PING", 0))
+	f.Add(testFrame(f, "PING", 3))
+	f.Add(append(testFrame(f, "PING", 0), 0))
+
+	f.Fuzz(func(t *testing.T, record []byte) {
+		msg, err := decodePacket(record, nil, 1024, 4)
+		if err != nil {
+			return
+		}
+		if IPCMSG_HEADER_SIZE+len(msg.data) != len(record) {
+			t.Fatalf("record of %d bytes decoded as a %d bytes payload", len(record), len(msg.data))
+		}
+		var data string
+		msg.TryUnmarshal(&data)
+	})
+}
+
+func TestDecodePacketClosesUnclaimedFds(t *testing.T) {
+	fds := make([]int, 2)
+	for i := range fds {
+		fds[i], _ = syscall.Dup(0)
+	}
+
+	msg, err := decodePacket(testFrame(t, "PING", 0), fds, 1024, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.fds) != 0 {
+		t.Fatalf("unexpected fds %v", msg.fds)
+	}
+	for _, fd := range fds {
+		var stat syscall.Stat_t
+		if err := syscall.Fstat(fd, &stat); !errors.Is(err, syscall.EBADF) {
+			t.Fatalf("fd %d leaked", fd)
+		}
+	}
+}
+
+func TestDecodePacketRejectsUnknownKind(t *testing.T) {
+	frame := testFrame(t, "PING", 0)
+	// the kind follows the 16 bytes id and 4 bytes type
+	frame[20] = byte(IPCMSG_KIND_ERROR + 1)
+	if _, err := decodePacket(frame, nil, 1024, 4); !errors.Is(err, ErrMalformedMessage) {
+		t.Fatalf("unknown kind decoded with %v", err)
+	}
+}
@@ -0,0 +1,80 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// MsgType is a message type bound to the Go type of its payload,
+// so that the compiler catches payload mismatches.
+type MsgType[T any] IPCMsgType
+
+// Register registers a message type carrying T payloads under an explicit ID.
+// T must be a concrete type, it panics if T is an interface.
+func Register[T any](id uint32, name string) MsgType[T] {
+	if reflect.TypeOf((*T)(nil)).Elem().Kind() == reflect.Interface {
+		panic(fmt.Sprintf("IPC message type %d (%s): interface payload type", id, name))
+	}
+	var zero T
+	return MsgType[T](NewIPCMsgTypeID(id, name, zero))
+}
+
+// Send is Channel.MessageFds for a typed message type.
+func Send[T any](channel *Channel, msgtype MsgType[T], v T, fds ...int) error {
+	return channel.MessageFds(IPCMsgType(msgtype), v, fds)
+}
+
+// Reply is IPCMessage.ReplyFds for a typed message type.
+func Reply[T any](msg *IPCMessage, msgtype MsgType[T], v T, fds ...int) error {
+	return msg.ReplyFds(IPCMsgType(msgtype), v, fds)
+}
+
+// Handle registers a handler receiving decoded T payloads. a payload that
+// can't be decoded is reported to the OnError hook and answered with an error
+// if it was a query, the channel keeps serving.
+func Handle[T any](channel *Channel, msgtype MsgType[T], handler func(T, *IPCMessage)) {
+	channel.Handler(IPCMsgType(msgtype), func(msg *IPCMessage) {
+		var v T
+		if err := msg.TryUnmarshal(&v); err != nil {
+			closeFds(msg.fds)
+			err = fmt.Errorf("%v: %w", IPCMsgType(msgtype), err)
+			channel.report(channel.errorf("%w", err))
+			if msg.hdr.Kind == IPCMSG_KIND_REQUEST {
+				msg.ReplyError(err)
+			}
+			return
+		}
+		handler(v, msg)
+	})
+}
+
+// Call sends a typed query and decodes its reply as a Resp, the reply message
+// is returned as well for the FDs it may carry.
+func Call[Req, Resp any](ctx context.Context, channel *Channel, msgtype MsgType[Req], req Req, fds ...int) (Resp, *IPCMessage, error) {
+	var resp Resp
+	reply, err := channel.queryContext(ctx, IPCMsgType(msgtype), req, fds)
+	if err != nil {
+		return resp, nil, err
+	}
+	if err := reply.TryUnmarshal(&resp); err != nil {
+		return resp, reply, err
+	}
+	return resp, reply, nil
+}
@@ -1,5 +1,5 @@
 module github.com/poolpOrg/go-ipcmsg
 
-go 1.16
+go 1.18
 
 require github.com/google/uuid v1.3.0
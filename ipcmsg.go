@@ -17,41 +17,142 @@
 package ipcmsg
 
 import (
-	"bytes"
-	"encoding/binary"
-	"encoding/gob"
-	"log"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"os"
 	"reflect"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 )
 
+var (
+	ErrClosed           = errors.New("ipcmsg: channel closed")
+	ErrPeerClosed       = errors.New("ipcmsg: peer closed the channel")
+	ErrShortMessage     = errors.New("ipcmsg: short message")
+	ErrTruncated        = errors.New("ipcmsg: truncated message")
+	ErrMalformedMessage = errors.New("ipcmsg: malformed message")
+	ErrMessageTooLarge  = errors.New("ipcmsg: message too large")
+	ErrTooManyFds       = errors.New("ipcmsg: too many fds")
+	ErrUnexpectedType   = errors.New("ipcmsg: unexpected message type")
+	ErrNoReply          = errors.New("ipcmsg: request not answered")
+	ErrHandlerPanic     = errors.New("ipcmsg: handler panicked")
+)
+
 type Channel struct {
-	name string
+	// accessed atomically, kept first for 64-bit alignment on 32-bit platforms
+	writeTimeout int64
+	violations   uint64
+
+	name   string
+	conn   *net.UnixConn
+	sotype int
+
+	peerCred    PeerCred
+	peerCredErr error
 
 	w  chan *IPCMessage
 	r  chan *IPCMessage
 	mu sync.Mutex
+	in inbuf
+
+	muCodec sync.Mutex
+	codec   Codec
 
-	muQueries sync.Mutex
-	queries   map[uuid.UUID]chan *IPCMessage
+	maxSize       uint32
+	maxFds        uint32
+	maxDecodeSize uint32
+
+	muClose    sync.Mutex
+	closed     bool
+	closing    chan struct{}
+	writerDone chan struct{}
+	readerDone chan struct{}
+
+	muQueries   sync.Mutex
+	queries     map[uuid.UUID]chan *IPCMessage
+	abandoned   map[uuid.UUID]struct{}
+	abandonOrd  []uuid.UUID
+	onLateReply func(*IPCMessage)
 
 	muHandlers sync.Mutex
 	handlers   map[IPCMsgType]func(*IPCMessage)
+
+	muPolicy    sync.Mutex
+	policy      *Policy
+	onViolation func(error)
+
+	muDispatch     sync.Mutex
+	dispatchConfig DispatchConfig
+	dispatchGen    uint64
+	dispatchDone   chan bool
+	workers        *sync.Cond
+	workersBusy    int
+	workersLimit   int
+
+	muKeepalive   sync.Mutex
+	keepaliveStop chan struct{}
+	pingEpoch     time.Time
+	pingPending   bool
+	pingsMissed   int
+	rtt           time.Duration
+
+	muErr        sync.Mutex
+	err          error
+	onError      func(error)
+	onDisconnect func(error)
+	hooksRun     bool
+	failed       chan struct{}
+
+	// set when the peer is a process spawned by Cmd.Start()
+	cmd *Cmd
+
+	// set when the peer is a client accepted by a Server
+	server *Server
+
+	muState sync.Mutex
+	state   interface{}
 }
 
-const IPCMSG_HEADER_SIZE = 31
+const IPCMSG_HEADER_SIZE = 35
+
+// default maximum size of a message payload, see Channel.SetMaxMessageSize()
+const IPCMSG_MAX_SIZE = 16 * 1024 * 1024
 
-type IPCMsgType uint32
+// default maximum size of a received payload decoded by a codec other than
+// RawCodec, see Channel.SetMaxDecodeSize()
+const IPCMSG_MAX_DECODE_SIZE = 1024 * 1024
+
+// default maximum number of FDs attached to a message, see Channel.SetMaxFds()
+const IPCMSG_MAX_FDS = 16
+
+// number of received messages queued for Dispatch() or ChannelIn(), the reader
+// goes on routing replies past them so that a handler waiting on a query isn't
+// stuck behind a message the peer sent before replying
+const IPCMSG_MAX_QUEUED = 64
+
+// how long Close() waits for the messages already handed to the channel to be
+// sent, a peer not reading for that long moves the channel into a failed state
+const IPCMSG_CLOSE_TIMEOUT = 5 * time.Second
+
+// number of given up queries whose late reply is still expected,
+// see Channel.OnLateReply()
+const IPCMSG_MAX_ABANDONED = 1024
 
 type ipcMsgHdr struct {
 	Id     uuid.UUID
 	Type   IPCMsgType
-	Size   uint16
-	HasFd  uint8
+	Kind   IPCMsgKind
+	Codec  CodecID
+	Size   uint32
+	NumFds uint8
 	Peerid uint32
 	Pid    uint32
 }
@@ -59,274 +160,941 @@ type ipcMsgHdr struct {
 type IPCMessage struct {
 	channel *Channel
 	hdr     ipcMsgHdr
-	fd      int
+	fds     []int
 	data    []byte
-}
 
-var msgTypes = make(map[IPCMsgType]string)
+	// set once a request was replied to
+	replied int32
 
-func NewIPCMsgType(msgObject interface{}) IPCMsgType {
-	msgType := IPCMsgType(len(msgTypes))
-	msgTypes[msgType] = reflect.TypeOf(msgObject).Name()
-	gob.Register(msgObject)
-	return msgType
+	// set by Dispatch() for its handler to hand dispatching over while it
+	// waits on a query, until handled is
+	yield   func() func()
+	handled int32
 }
 
+// NewChannel is like TryNewChannel but panics if the channel can't be set up.
 func NewChannel(name string, peerid int, fd int) *Channel {
+	channel, err := TryNewChannel(name, peerid, fd)
+	if err != nil {
+		panic(err)
+	}
+	return channel
+}
+
+// TryNewChannel sets up a channel on top of fd, which must be a connected socket.
+// I/O failures do not abort the program, they move the channel into a failed
+// state reported by Err() and the OnError() hook.
+//
+// SOCK_STREAM, SOCK_SEQPACKET and SOCK_DGRAM sockets are supported, on the
+// last two each message is sent as a single record, which must fit in the
+// socket buffer: the default maximum message size is lowered accordingly.
+// a SOCK_DGRAM socket never tells that the peer went away, only sending to
+// it fails: SetKeepalive() is the way to notice it.
+//
+// the channel takes ownership of fd, which is switched to non-blocking mode
+// and handed to the Go netpoller, unless an error is returned.
+func TryNewChannel(name string, peerid int, fd int) (*Channel, error) {
+	return newChannel(name, peerid, fd, nil)
+}
+
+func newChannel(name string, peerid int, fd int, cmd *Cmd) (*Channel, error) {
+	sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return nil, fmt.Errorf("channel %s: fd %d: %w", name, fd, err)
+	}
+
+	maxSize := IPCMSG_MAX_SIZE
+	switch sotype {
+	case syscall.SOCK_STREAM:
+	case syscall.SOCK_SEQPACKET, syscall.SOCK_DGRAM:
+		sndbuf, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF)
+		if err != nil {
+			return nil, fmt.Errorf("channel %s: fd %d: %w", name, fd, err)
+		}
+		if sndbuf-IPCMSG_HEADER_SIZE < maxSize {
+			maxSize = sndbuf - IPCMSG_HEADER_SIZE
+		}
+	default:
+		return nil, fmt.Errorf("channel %s: fd %d: unsupported socket type %d", name, fd, sotype)
+	}
+
+	conn, err := unixConn(fd)
+	if err != nil {
+		return nil, fmt.Errorf("channel %s: fd %d: %w", name, fd, err)
+	}
+
 	channel := &Channel{}
 	pid := os.Getpid()
 
 	channel.name = name
+	channel.conn = conn
+	channel.cmd = cmd
+	channel.peerCred, channel.peerCredErr = getPeerCred(conn)
+	channel.sotype = sotype
+	channel.maxSize = uint32(maxSize)
+	channel.maxFds = IPCMSG_MAX_FDS
+	channel.maxDecodeSize = IPCMSG_MAX_DECODE_SIZE
+	channel.codec = GobCodec{}
 	channel.queries = make(map[uuid.UUID]chan *IPCMessage)
+	channel.abandoned = make(map[uuid.UUID]struct{})
 	channel.handlers = make(map[IPCMsgType]func(*IPCMessage))
+	channel.workers = sync.NewCond(&channel.muDispatch)
 	channel.w = make(chan *IPCMessage)
-	channel.r = make(chan *IPCMessage)
+	channel.r = make(chan *IPCMessage, IPCMSG_MAX_QUEUED)
+	channel.failed = make(chan struct{})
+	channel.closing = make(chan struct{})
+	channel.writerDone = make(chan struct{})
+	channel.readerDone = make(chan struct{})
 
 	// read message from write channel and send to peer fd
 	go func() {
-		for msg := range channel.w {
-			msg.hdr.Peerid = uint32(peerid)
-			msg.hdr.Pid = uint32(pid)
-
-			// pack msg header and msg data into output buf
-			obuf := make([]byte, 0)
-
-			var packed bytes.Buffer
-			if err := binary.Write(&packed, binary.BigEndian, &msg.hdr); err != nil {
-				log.Fatal("NewChannel: binary.Write: ", err)
-			}
-			obuf = append(obuf, packed.Bytes()...)
-			obuf = append(obuf, msg.data...)
-
-			// if msg has no FD attached, send as is
-			if msg.hdr.HasFd == 0 {
-				err := syscall.Sendmsg(fd, obuf, nil, nil, 0)
-				if err != nil {
-					log.Fatal("NewChannel: syscall.Sendmsg (#1): ", err)
-				}
-				// annnnnnnd... we're done for this msg
-				continue
+		defer close(channel.writerDone)
+		for {
+			var msg *IPCMessage
+			select {
+			case msg = <-channel.w:
+			case <-channel.failed:
+				return
 			}
 
-			// an FD is attached, we need to craft a UnixRights control message
-			channel.mu.Lock()
-			err := syscall.Sendmsg(fd, obuf, syscall.UnixRights(msg.fd), nil, 0)
-			if err != nil {
-				log.Fatal("NewChannel: syscall.Sendmsg (#2): ", err)
+			// Close() hands us a nil msg once everything before it was sent
+			if msg == nil {
+				return
 			}
 
-			err = syscall.Close(msg.fd)
-			if err != nil {
-				log.Fatal("NewChannel: syscall.Close: ", err)
+			msg.hdr.Peerid = uint32(peerid)
+			msg.hdr.Pid = uint32(pid)
+			if err := channel.send(msg); err != nil {
+				channel.fail(err)
+				return
 			}
-			channel.mu.Unlock()
 		}
 	}()
 
 	// read message from peer fd and write to read channel
 	go func() {
-		// oh gosh... the fun begins
-		for {
+		// hooks run last so that they may Close() the channel
+		defer channel.runHooks()
+		defer close(channel.readerDone)
+		defer close(channel.r)
+		if err := channel.recv(); err != nil {
+			channel.fail(err)
+		}
+	}()
 
-			// a buffer to hold the data
-			buf := make([]byte, 64*1024)
+	return channel, nil
+}
 
-			// a cmsgbuf for control message, we only expect 1 fd (4 bytes)
-			cmsgbuf := make([]byte, syscall.CmsgSpace(1*4))
+// unixConn turns fd into a *net.UnixConn, leaving fd untouched on error.
+func unixConn(fd int) (*net.UnixConn, error) {
+	nfd, err := syscall.Dup(fd)
+	if err != nil {
+		return nil, err
+	}
+	file := os.NewFile(uintptr(nfd), "")
+	defer file.Close()
 
-			// read a msg, for now only expects blocking IO
-			n, oobn, _, _, err := syscall.Recvmsg(fd, buf, cmsgbuf, 0)
-			if err != nil {
-				log.Fatal("NewChannel: syscall.Recvmsg:", err)
+	conn, err := net.FileConn(file)
+	if err != nil {
+		return nil, err
+	}
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		conn.Close()
+		return nil, syscall.EAFNOSUPPORT
+	}
+	syscall.Close(fd)
+	return uconn, nil
+}
+
+func (channel *Channel) send(msg *IPCMessage) error {
+	// pack msg header and msg data into output buf
+	obuf, err := encodeMessage(msg)
+	if err != nil {
+		closeFds(msg.fds)
+		return channel.errorf("binary.Write: %w", err)
+	}
+
+	var deadline time.Time
+	if timeout := channel.WriteTimeout(); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := channel.conn.SetWriteDeadline(deadline); err != nil {
+		closeFds(msg.fds)
+		return channel.errorf("SetWriteDeadline: %w", err)
+	}
+
+	// if msg has no FD attached, send as is
+	if len(msg.fds) == 0 {
+		if err := channel.sendmsg(obuf, nil); err != nil {
+			return channel.errorf("WriteMsgUnix: %w", err)
+		}
+		// annnnnnnd... we're done for this msg
+		return nil
+	}
+
+	// FDs are attached, we need to craft a UnixRights control message,
+	// the FDs are ours from now on so close them whatever the outcome
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+	err = channel.sendmsg(obuf, syscall.UnixRights(msg.fds...))
+	for _, fd := range msg.fds {
+		if cerr := syscall.Close(fd); err == nil && cerr != nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return channel.errorf("WriteMsgUnix: %w", err)
+	}
+	return nil
+}
+
+// sendmsg writes a whole frame, the control message goes along its first byte.
+// a stream socket may take less than the frame, the remainder is then written
+// without control message.
+func (channel *Channel) sendmsg(buf []byte, oob []byte) error {
+	n, _, err := channel.conn.WriteMsgUnix(buf, oob, nil)
+	if err != nil {
+		return err
+	}
+	if n < len(buf) {
+		if channel.sotype != syscall.SOCK_STREAM {
+			return ErrTruncated
+		}
+		_, err = channel.conn.Write(buf[n:])
+	}
+	return err
+}
+
+func (channel *Channel) recv() error {
+	defer channel.in.reset()
+
+	// a buffer to hold the data, a whole record on packet sockets
+	var buf []byte
+
+	// a cmsgbuf for control message, sized for as many fds (4 bytes each)
+	// as a message may carry
+	var cmsgbuf []byte
+
+	// oh gosh... the fun begins
+	for {
+		size := 64 * 1024
+		if channel.sotype != syscall.SOCK_STREAM {
+			size = IPCMSG_HEADER_SIZE + channel.MaxMessageSize()
+		}
+		if len(buf) != size {
+			buf = make([]byte, size)
+		}
+		if size := syscall.CmsgSpace(channel.MaxFds() * 4); len(cmsgbuf) != size {
+			cmsgbuf = make([]byte, size)
+		}
+
+		// read a msg, the netpoller parks us until there's something to read
+		// or the channel fails and sets a deadline in the past
+		n, oobn, flags, _, err := channel.conn.ReadMsgUnix(buf, cmsgbuf)
+		if err != nil {
+			select {
+			case <-channel.failed:
+				return nil
+			default:
 			}
-			if n == 0 {
-				break
+			if err == io.EOF {
+				n = 0
+			} else {
+				return channel.errorf("ReadMsgUnix: %w", err)
 			}
+		}
+		// a datagram socket has no EOF, an empty datagram is just malformed
+		if n == 0 && channel.sotype != syscall.SOCK_DGRAM {
+			if channel.in.pending() {
+				return channel.errorf("%w", ErrShortMessage)
+			}
+			return channel.disconnected()
+		}
 
-			buf = buf[:n]
+		// sometimes we have FDs, sometimes we don't
+		// caller can detect if one was lost as IPCMessage.HasFd() is true
+		// and one of IPCMessage.Fds() is -1
+		fds, err := channel.parseRights(cmsgbuf[:oobn])
+		if err != nil {
+			return err
+		}
+
+		// the kernel dropped FDs that didn't fit, there's no telling which
+		// messages they belonged to so the stream can't be trusted anymore
+		if flags&syscall.MSG_CTRUNC != 0 {
+			closeFds(fds)
+			return channel.errorf("control message truncated: %w", ErrTooManyFds)
+		}
 
-			// sometimes we have an FD, sometimes we don't
-			// assume there's a control message and try parsing it,
-			// if it fails then we assume there's no FD
-			// caller can detect this is IPCMsgHdr.HasFlag is 1 and IpcMsg.Fd == -1
-			channel.mu.Lock()
-			cmsg := true
-			scms, err := syscall.ParseSocketControlMessage(cmsgbuf[:oobn])
+		var msgs []*IPCMessage
+		if channel.sotype == syscall.SOCK_STREAM {
+			msgs, err = channel.recvStream(buf[:n], fds)
+		} else {
+			msgs, err = channel.recvPacket(buf[:n], fds, flags)
+		}
+		if err != nil {
+			return err
+		}
+
+		for i, msg := range msgs {
+			// peerid and pid are left as the peer claims them,
+			// IPCMessage.Sender() is what can be trusted
+			msg.channel = channel
+
+			// messages the peer is not allowed to send go no further,
+			// control messages are ours and pongs are handled right here
+			// so a busy Dispatch() doesn't make the peer look unresponsive
+			var allowed bool
+			switch msg.hdr.Type {
+			case IPCMSG_PONG:
+				err = channel.pong(msg)
+			case IPCMSG_PING:
+				allowed = true
+			case IPCMSG_ERROR:
+				// errors answering our queries may come from the peer
+				// library itself, a policy isn't expected to list them
+				if msg.hdr.Kind == IPCMSG_KIND_ERROR && msg.hdr.NumFds == 0 && channel.awaitsReply(msg.hdr.Id) {
+					allowed = true
+					break
+				}
+				allowed, err = channel.checkPolicy(msg)
+			default:
+				allowed, err = channel.checkPolicy(msg)
+			}
 			if err != nil {
-				if err != syscall.EINVAL {
-					log.Fatal("NewChannel: syscall.ParseSocketControlMessage:", err)
+				for _, msg := range msgs[i+1:] {
+					closeFds(msg.fds)
 				}
-				cmsg = false
+				return err
+			}
+			if !allowed {
+				continue
 			}
 
-			pfd := -1
-			if cmsg {
-				// we have a control message ...
-				// we're only supposed to have one
-				if len(scms) != 1 {
-					log.Fatal("received more than one control message")
-				}
-				fds, err := syscall.ParseUnixRights(&scms[0])
-				if err != nil {
-					log.Fatal("NewChannel: syscall.ParseUnixRights:", err)
-				}
+			// replies go straight to their query, which may be waiting
+			// from within a handler that holds Dispatch() up
+			if msg.hdr.Kind == IPCMSG_KIND_REPLY || msg.hdr.Kind == IPCMSG_KIND_ERROR {
+				channel.routeReply(msg)
+				continue
+			}
 
-				// we're only supposed to have one FD
-				if len(fds) != 1 {
-					log.Fatal("received more than one FD")
-				}
-				pfd = fds[0]
-				if npfd, err := syscall.Dup(pfd); err != nil {
-					log.Fatal("NewChannel: syscall.Dup:", err)
-				} else {
-					if err := syscall.Close(pfd); err != nil {
-						log.Fatal("NewChannel: syscall.Close:", err)
-					}
-					pfd = npfd
+			// message is ready for caller
+			select {
+			case channel.r <- msg:
+			case <-channel.failed:
+				for _, msg := range msgs[i:] {
+					closeFds(msg.fds)
 				}
+				return nil
 			}
-			channel.mu.Unlock()
-
-			// we may have multiple messages crammed in our input buffer
-			// process them sequentially, parsing header and extracting data
-			for {
-				// first, decode a header
-				var hdr_bin bytes.Buffer
-				var hdr ipcMsgHdr
-				hdr_bin.Write(buf[:IPCMSG_HEADER_SIZE])
-				err = binary.Read(&hdr_bin, binary.BigEndian, &hdr)
-				if err != nil {
-					log.Fatal("NewChannel: binary.Read:", err)
-				}
+		}
+	}
+}
 
-				// unsure if this can happen, sanity check
-				if len(buf) < IPCMSG_HEADER_SIZE+int(hdr.Size) {
-					log.Fatal("packet too small")
-				}
+// recvStream handles a read from a stream socket: messages may straddle reads,
+// so accumulate in the channel input buffer and only return the complete ones.
+func (channel *Channel) recvStream(buf []byte, fds []int) ([]*IPCMessage, error) {
+	channel.in.append(buf, fds)
 
-				// now that we have a header, reset peerid and pid
-				// extract the right amount of data from input buffer
-				// and if a FD is supposed to be attached, use the one
-				// we extracted from control message
-				msg := &IPCMessage{}
-				msg.channel = channel
-				msg.hdr = hdr
-				msg.hdr.Peerid = uint32(peerid)
-				msg.hdr.Pid = uint32(pid)
-				msg.data = buf[IPCMSG_HEADER_SIZE : IPCMSG_HEADER_SIZE+int(msg.hdr.Size)]
-				msg.fd = -1
-				if msg.hdr.HasFd != 0 {
-					if pfd == -1 {
-						// FD exhaustion on receiving end most-likely
-					}
-					msg.fd = pfd
-					pfd = -1
-				}
+	msgs := make([]*IPCMessage, 0)
+	for {
+		msg, err := channel.in.next(channel.MaxMessageSize(), channel.MaxFds())
+		if err != nil {
+			for _, msg := range msgs {
+				closeFds(msg.fds)
+			}
+			return nil, channel.errorf("%w", err)
+		}
+		if msg == nil {
+			break
+		}
+		msgs = append(msgs, msg)
+	}
 
-				// discard consumed data from input buffer
-				buf = buf[IPCMSG_HEADER_SIZE+int(msg.hdr.Size):]
+	// what's left can only belong to the partial message at the head of the
+	// buffer, a peer piling FDs up without messages to claim them is hostile
+	if channel.in.pendingFds() > channel.MaxFds() {
+		for _, msg := range msgs {
+			closeFds(msg.fds)
+		}
+		return nil, channel.errorf("%d pending fds: %w", channel.in.pendingFds(), ErrTooManyFds)
+	}
+	return msgs, nil
+}
 
-				// message is ready for caller
-				channel.r <- msg
+// recvPacket handles a read from a seqpacket or datagram socket: the record is
+// exactly one message and the FDs that came along are the ones it carries.
+func (channel *Channel) recvPacket(buf []byte, fds []int, flags int) ([]*IPCMessage, error) {
+	if flags&syscall.MSG_TRUNC != 0 {
+		closeFds(fds)
+		return nil, channel.errorf("%w", ErrTruncated)
+	}
 
-				// input buffer is empty, go back to read loop
-				if len(buf) == 0 {
-					break
-				}
+	msg, err := decodePacket(buf, fds, channel.MaxMessageSize(), channel.MaxFds())
+	if err != nil {
+		return nil, channel.errorf("%w", err)
+	}
+	return []*IPCMessage{msg}, nil
+}
 
-				// not sure if short reads can happen,
-				// if so they'll be caught by the earlier log.Fatal()
-				// and I'll move the input buffer out of the goroutine
-				// into the Channel
-			}
+// parseRights extracts the FDs passed along control messages, if any.
+func (channel *Channel) parseRights(cmsgbuf []byte) ([]int, error) {
+	channel.mu.Lock()
+	defer channel.mu.Unlock()
+
+	// assume there's a control message and try parsing it,
+	// if it fails then we assume there's no FD
+	scms, err := syscall.ParseSocketControlMessage(cmsgbuf)
+	if err != nil {
+		if err != syscall.EINVAL {
+			return nil, channel.errorf("syscall.ParseSocketControlMessage: %w", err)
 		}
-	}()
+		return nil, nil
+	}
 
-	return channel
+	fds := make([]int, 0)
+	for i := range scms {
+		rights, err := syscall.ParseUnixRights(&scms[i])
+		if err != nil {
+			closeFds(fds)
+			return nil, channel.errorf("syscall.ParseUnixRights: %w", err)
+		}
+		fds = append(fds, rights...)
+	}
+
+	// received FDs must not leak into the children we spawn, the netpoller
+	// asks for close-on-exec where the system supports it
+	for _, fd := range fds {
+		syscall.CloseOnExec(fd)
+	}
+	return fds, nil
 }
 
-func (channel *Channel) Dispatch() <-chan bool {
-	done := make(chan bool)
-	go func() {
-		for msg := range channel.r {
-			channel.muQueries.Lock()
-			callbackChannel, exists := channel.queries[msg.hdr.Id]
-			delete(channel.queries, msg.hdr.Id)
-			channel.muQueries.Unlock()
-			if exists {
-				callbackChannel <- msg
-				continue
-			}
+func closeFd(fd int) {
+	if fd != -1 {
+		syscall.Close(fd)
+	}
+}
 
-			handler, exists := channel.handlers[msg.hdr.Type]
-			if !exists {
-				log.Fatalf("channel %s: received unexpected message type %d", channel.name, msg.hdr.Type)
-			}
+func closeFds(fds []int) {
+	for _, fd := range fds {
+		closeFd(fd)
+	}
+}
+
+func (channel *Channel) errorf(format string, a ...interface{}) error {
+	return fmt.Errorf("channel %s: "+format, append([]interface{}{channel.name}, a...)...)
+}
+
+// fail moves the channel into a failed state, only the first error is kept.
+// it wakes up the reader and writer goroutines, pending queries and Dispatch.
+func (channel *Channel) fail(err error) {
+	channel.muErr.Lock()
+	if channel.err != nil {
+		channel.muErr.Unlock()
+		return
+	}
+	channel.err = err
+	close(channel.failed)
+	channel.muErr.Unlock()
+
+	// the reader and writer may be parked in the netpoller, this wakes them up
+	// and the shutdown lets the peer know we're gone
+	channel.conn.SetDeadline(time.Unix(1, 0))
+	if rawConn, err := channel.conn.SyscallConn(); err == nil {
+		rawConn.Control(func(fd uintptr) {
+			syscall.Shutdown(int(fd), syscall.SHUT_RDWR)
+		})
+	}
+}
+
+// runHooks calls the OnError and OnDisconnect hooks once the reader is gone,
+// which happens shortly after the channel failed.
+func (channel *Channel) runHooks() {
+	channel.muErr.Lock()
+	channel.hooksRun = true
+	err := channel.err
+	onError := channel.onError
+	onDisconnect := channel.onDisconnect
+	channel.muErr.Unlock()
+
+	if onError != nil && err != ErrClosed {
+		onError(err)
+	}
+	if onDisconnect != nil {
+		onDisconnect(err)
+	}
+}
 
-			handler(msg)
+// disconnected tells why the peer went away, for a spawned child that's its
+// exit status if it exits shortly after closing its end.
+func (channel *Channel) disconnected() error {
+	if cmd := channel.cmd; cmd != nil {
+		select {
+		case <-cmd.exited:
+			return channel.errorf("%w", &ExitError{Pid: cmd.Process.Pid, State: cmd.ProcessState})
+		case <-time.After(IPCMSG_EXIT_GRACE):
+		case <-channel.failed:
 		}
-		done <- true
-	}()
-	return done
+	}
+	return channel.errorf("%w", ErrPeerClosed)
+}
+
+// Done returns a channel closed once the channel is down, whether it failed,
+// the peer went away or it was closed, Err() tells which.
+func (channel *Channel) Done() <-chan struct{} {
+	return channel.failed
+}
+
+// report hands err to the OnError hook without failing the channel.
+func (channel *Channel) report(err error) {
+	channel.muErr.Lock()
+	onError := channel.onError
+	channel.muErr.Unlock()
+
+	if onError != nil {
+		onError(err)
+	}
+}
+
+// Err returns the error that moved the channel into a failed state,
+// ErrClosed if it was closed, or nil if the channel is still operational.
+func (channel *Channel) Err() error {
+	channel.muErr.Lock()
+	defer channel.muErr.Unlock()
+	return channel.err
+}
+
+// OnError registers a hook called once when the channel fails,
+// it is called right away if the channel has already failed.
+// it is also called with a PanicError for every handler panic recovered
+// by Dispatch(), which keeps serving.
+func (channel *Channel) OnError(hook func(error)) {
+	channel.muErr.Lock()
+	channel.onError = hook
+	err := channel.err
+	hooksRun := channel.hooksRun
+	channel.muErr.Unlock()
+
+	if hooksRun && hook != nil && err != ErrClosed {
+		hook(err)
+	}
+}
+
+// OnDisconnect registers a hook called once with the reason the channel went
+// down, including ErrClosed, it is called right away if it already is.
+// like OnError, it may Close() the channel.
+func (channel *Channel) OnDisconnect(hook func(error)) {
+	channel.muErr.Lock()
+	channel.onDisconnect = hook
+	err := channel.err
+	hooksRun := channel.hooksRun
+	channel.muErr.Unlock()
+
+	if hooksRun && hook != nil {
+		hook(err)
+	}
+}
+
+// SetMaxMessageSize sets the maximum payload size of messages sent and received,
+// sending a larger message fails with ErrMessageTooLarge and receiving one
+// moves the channel into a failed state. both ends should agree on it.
+func (channel *Channel) SetMaxMessageSize(size int) {
+	if size < 0 || int64(size) > math.MaxInt32-IPCMSG_HEADER_SIZE {
+		size = math.MaxInt32 - IPCMSG_HEADER_SIZE
+	}
+	atomic.StoreUint32(&channel.maxSize, uint32(size))
+}
+
+func (channel *Channel) MaxMessageSize() int {
+	return int(atomic.LoadUint32(&channel.maxSize))
+}
+
+// SetMaxDecodeSize sets the maximum size of a received payload TryUnmarshal()
+// decodes with a codec other than RawCodec, as decoding may allocate a lot more
+// than the payload size. larger payloads fail with ErrMessageTooLarge, a
+// negative size means no limit other than the maximum message size.
+func (channel *Channel) SetMaxDecodeSize(size int) {
+	if size < 0 || int64(size) > math.MaxInt32 {
+		size = math.MaxInt32
+	}
+	atomic.StoreUint32(&channel.maxDecodeSize, uint32(size))
+}
+
+func (channel *Channel) MaxDecodeSize() int {
+	return int(atomic.LoadUint32(&channel.maxDecodeSize))
+}
+
+// SetMaxFds sets the maximum number of FDs attached to messages sent and
+// received, the receive control buffer is sized accordingly.
+func (channel *Channel) SetMaxFds(n int) {
+	if n < 0 || n > math.MaxUint8 {
+		n = math.MaxUint8
+	}
+	atomic.StoreUint32(&channel.maxFds, uint32(n))
+}
+
+func (channel *Channel) MaxFds() int {
+	return int(atomic.LoadUint32(&channel.maxFds))
+}
+
+// SetWriteTimeout bounds the time spent writing a single message to the socket,
+// a peer not reading for that long moves the channel into a failed state.
+// the default of zero means no timeout.
+func (channel *Channel) SetWriteTimeout(timeout time.Duration) {
+	atomic.StoreInt64(&channel.writeTimeout, int64(timeout))
+}
+
+func (channel *Channel) WriteTimeout() time.Duration {
+	return time.Duration(atomic.LoadInt64(&channel.writeTimeout))
+}
+
+// awaitsReply reports whether id is that of a query sent on the channel which
+// hasn't been answered yet, whether it's still waited for or not.
+func (channel *Channel) awaitsReply(id uuid.UUID) bool {
+	channel.muQueries.Lock()
+	defer channel.muQueries.Unlock()
+	_, exists := channel.queries[id]
+	_, late := channel.abandoned[id]
+	return exists || late
+}
+
+// routeReply hands a reply over to the query waiting for it.
+func (channel *Channel) routeReply(msg *IPCMessage) {
+	channel.muQueries.Lock()
+	wait, exists := channel.queries[msg.hdr.Id]
+	delete(channel.queries, msg.hdr.Id)
+	_, late := channel.abandoned[msg.hdr.Id]
+	delete(channel.abandoned, msg.hdr.Id)
+	onLateReply := channel.onLateReply
+	channel.muQueries.Unlock()
+
+	switch {
+	case exists:
+		wait <- msg
+	case late && onLateReply != nil:
+		// reply to a query that gave up waiting
+		onLateReply(msg)
+	default:
+		// nobody asked for it
+		closeFds(msg.fds)
+	}
 }
 
+// Handler registers the handler of msgtype messages. a request, as sent by
+// Query(), must be replied to before the handler returns: the peer gets an
+// error reply otherwise.
 func (channel *Channel) Handler(msgtype IPCMsgType, handler func(*IPCMessage)) {
 	channel.muHandlers.Lock()
 	defer channel.muHandlers.Unlock()
 	channel.handlers[msgtype] = handler
 }
 
-func createMessage(msgtype IPCMsgType, data interface{}, fd int) *IPCMessage {
-	if reflecType, exists := msgTypes[msgtype]; !exists {
+// QueryHandler registers a handler of msgtype requests which returns its reply
+// rather than sending it: a replytype message carrying reply and fd, -1 if
+// there's none. if err is set, reply and fd are ignored and the query fails
+// on the other end with a RemoteError.
+func (channel *Channel) QueryHandler(msgtype IPCMsgType, replytype IPCMsgType, handler func(*IPCMessage) (interface{}, int, error)) {
+	channel.Handler(msgtype, queryHandler(replytype, handler))
+}
+
+func queryHandler(replytype IPCMsgType, handler func(*IPCMessage) (interface{}, int, error)) func(*IPCMessage) {
+	return func(msg *IPCMessage) {
+		reply, fd, err := handler(msg)
+		switch {
+		case err != nil:
+			if msg.hdr.Kind == IPCMSG_KIND_REQUEST {
+				msg.ReplyError(err)
+			}
+		case msg.hdr.Kind == IPCMSG_KIND_REQUEST:
+			msg.Reply(replytype, reply, fd)
+		case fd != -1:
+			// sent with Message(), nobody waits for the reply
+			closeFd(fd)
+		}
+	}
+}
+
+// SetState attaches state to the channel, such as what a server knows of
+// a client, for handlers to find it with State().
+func (channel *Channel) SetState(state interface{}) {
+	channel.muState.Lock()
+	defer channel.muState.Unlock()
+	channel.state = state
+}
+
+func (channel *Channel) State() interface{} {
+	channel.muState.Lock()
+	defer channel.muState.Unlock()
+	return channel.state
+}
+
+// SetCodec selects the codec used for payloads sent on this channel,
+// unless their type has its own codec set with SetTypeCodec.
+func (channel *Channel) SetCodec(codec Codec) {
+	channel.muCodec.Lock()
+	defer channel.muCodec.Unlock()
+	channel.codec = codec
+}
+
+func (channel *Channel) codecFor(msgtype IPCMsgType) Codec {
+	muTypeCodecs.RLock()
+	codec, exists := typeCodecs[msgtype]
+	muTypeCodecs.RUnlock()
+	if exists {
+		return codec
+	}
+
+	channel.muCodec.Lock()
+	defer channel.muCodec.Unlock()
+	return channel.codec
+}
+
+func createMessage(codec Codec, msgtype IPCMsgType, data interface{}, fds []int) (*IPCMessage, error) {
+	if _, reflecType, exists := LookupIPCMsgType(msgtype); !exists {
 		panic("unregistered IPC message type")
 	} else {
-		if reflect.TypeOf(data).Name() != reflecType {
+		if reflect.TypeOf(data) != reflecType {
 			panic("creating IPC message with invalid data type")
 		}
 	}
 
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(data)
+	buf, err := codec.Marshal(data)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
 	msg := &IPCMessage{}
 	msg.hdr = ipcMsgHdr{}
 	msg.hdr.Id, _ = uuid.NewRandom()
 	msg.hdr.Type = msgtype
-	msg.hdr.Size = uint16(len(buf.Bytes()))
-	if fd == -1 {
-		msg.hdr.HasFd = 0
-	} else {
-		msg.hdr.HasFd = 1
+	msg.hdr.Codec = codec.ID()
+	if uint64(len(buf)) > math.MaxUint32 {
+		return nil, ErrMessageTooLarge
 	}
-	msg.data = buf.Bytes()
-	msg.fd = fd
+	msg.hdr.Size = uint32(len(buf))
+	if len(fds) > math.MaxUint8 {
+		return nil, ErrTooManyFds
+	}
+	msg.hdr.NumFds = uint8(len(fds))
+	msg.data = buf
+	msg.fds = fds
 
-	return msg
+	return msg, nil
 }
 
-func createReply(msg IPCMessage, msgtype IPCMsgType, data interface{}, fd int) *IPCMessage {
-	reply := createMessage(msgtype, data, fd)
+func createReply(msg IPCMessage, msgtype IPCMsgType, data interface{}, fds []int) (*IPCMessage, error) {
+	reply, err := createMessage(msg.channel.codecFor(msgtype), msgtype, data, fds)
+	if err != nil {
+		return nil, err
+	}
 	reply.hdr.Id = msg.hdr.Id
-	return reply
+	reply.hdr.Kind = IPCMSG_KIND_REPLY
+	return reply, nil
+}
+
+// fdList turns the single FD argument of Message, Query and Reply into a list.
+func fdList(fd int) []int {
+	if fd == -1 {
+		return nil
+	}
+	return []int{fd}
+}
+
+// write hands msg over to the writer goroutine, unless the channel has failed,
+// was closed or ctx is done, in which case the caller keeps ownership of the FD
+// attached to msg.
+func (channel *Channel) write(ctx context.Context, msg *IPCMessage) error {
+	channel.muClose.Lock()
+	closed := channel.closed
+	channel.muClose.Unlock()
+
+	if closed {
+		return ErrClosed
+	}
+	if len(msg.data) > channel.MaxMessageSize() {
+		return channel.errorf("%d bytes: %w", len(msg.data), ErrMessageTooLarge)
+	}
+	if len(msg.fds) > channel.MaxFds() {
+		return channel.errorf("%d fds: %w", len(msg.fds), ErrTooManyFds)
+	}
+
+	// once Close() queued its marker the writer takes nothing more,
+	// the closing case wins then
+	select {
+	case channel.w <- msg:
+		return nil
+	case <-channel.closing:
+		return ErrClosed
+	case <-channel.failed:
+		return channel.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
-func (channel *Channel) Message(msgtype IPCMsgType, data interface{}, fd int) {
-	channel.w <- createMessage(msgtype, data, fd)
+// Close flushes the messages already handed to the channel, closes the socket
+// and ChannelIn(). pending queries fail with ErrClosed, as do later calls to
+// Message, Query and Reply. a peer that doesn't take the messages within
+// IPCMSG_CLOSE_TIMEOUT doesn't hold Close() up, the channel fails instead.
+func (channel *Channel) Close() error {
+	return channel.closeWithin(IPCMSG_CLOSE_TIMEOUT)
 }
 
-func (channel *Channel) Query(msgtype IPCMsgType, data interface{}, fd int) *IPCMessage {
-	wait := make(chan *IPCMessage)
-	msg := createMessage(msgtype, data, fd)
+func (channel *Channel) closeWithin(timeout time.Duration) error {
+	channel.muClose.Lock()
+	if channel.closed {
+		channel.muClose.Unlock()
+		return ErrClosed
+	}
+	channel.closed = true
+	close(channel.closing)
+	channel.muClose.Unlock()
+
+	// queue a marker behind the writes taken so far and wait for the writer
+	// to drain, failing the channel wakes it up if the peer doesn't read
+	flushed := time.NewTimer(timeout)
+	defer flushed.Stop()
+	select {
+	case channel.w <- nil:
+		select {
+		case <-channel.writerDone:
+		case <-flushed.C:
+			channel.fail(channel.errorf("close: %w", context.DeadlineExceeded))
+		}
+	case <-channel.failed:
+	case <-flushed.C:
+		channel.fail(channel.errorf("close: %w", context.DeadlineExceeded))
+	}
+	<-channel.writerDone
+
+	channel.fail(ErrClosed)
+	<-channel.readerDone
+
+	channel.muQueries.Lock()
+	channel.abandoned = make(map[uuid.UUID]struct{})
+	channel.abandonOrd = nil
+	channel.muQueries.Unlock()
+
+	return channel.conn.Close()
+}
+
+func (channel *Channel) Message(msgtype IPCMsgType, data interface{}, fd int) error {
+	return channel.MessageFds(msgtype, data, fdList(fd))
+}
+
+// MessageFds is like Message but attaches several FDs in one go.
+func (channel *Channel) MessageFds(msgtype IPCMsgType, data interface{}, fds []int) error {
+	msg, err := createMessage(channel.codecFor(msgtype), msgtype, data, fds)
+	if err != nil {
+		return err
+	}
+	return channel.write(context.Background(), msg)
+}
+
+func (channel *Channel) Query(msgtype IPCMsgType, data interface{}, fd int) (*IPCMessage, error) {
+	return channel.QueryContext(context.Background(), msgtype, data, fd)
+}
+
+// QueryFds is like Query but attaches several FDs in one go.
+func (channel *Channel) QueryFds(msgtype IPCMsgType, data interface{}, fds []int) (*IPCMessage, error) {
+	return channel.queryContext(context.Background(), msgtype, data, fds)
+}
+
+// QueryContext sends a query and waits for its reply until ctx is done.
+// if the query is given up, a reply received later is passed to the
+// OnLateReply hook, or discarded if there is none, and never reaches a handler.
+// the FD is only consumed if the query was actually sent.
+func (channel *Channel) QueryContext(ctx context.Context, msgtype IPCMsgType, data interface{}, fd int) (*IPCMessage, error) {
+	return channel.queryContext(ctx, msgtype, data, fdList(fd))
+}
+
+func (channel *Channel) queryContext(ctx context.Context, msgtype IPCMsgType, data interface{}, fds []int) (*IPCMessage, error) {
+	return channel.queryFrom(ctx, nil, msgtype, data, fds)
+}
+
+// queryFrom sends a query from the handler of from, if not nil, which lets
+// the next messages be dispatched while it waits for the reply.
+func (channel *Channel) queryFrom(ctx context.Context, from *IPCMessage, msgtype IPCMsgType, data interface{}, fds []int) (*IPCMessage, error) {
+	wait := make(chan *IPCMessage, 1)
+	msg, err := createMessage(channel.codecFor(msgtype), msgtype, data, fds)
+	if err != nil {
+		return nil, err
+	}
+	msg.hdr.Kind = IPCMSG_KIND_REQUEST
 	channel.muQueries.Lock()
 	channel.queries[msg.hdr.Id] = wait
 	channel.muQueries.Unlock()
 
-	channel.w <- msg
-	return <-wait
+	if err := channel.write(ctx, msg); err != nil {
+		channel.forgetQuery(msg.hdr.Id, wait, false)
+		return nil, err
+	}
+	if from != nil {
+		resume := from.yieldDispatch()
+		defer resume()
+	}
+
+	select {
+	case reply := <-wait:
+		return channel.replyResult(reply)
+	case <-channel.failed:
+		if reply := channel.forgetQuery(msg.hdr.Id, wait, false); reply != nil {
+			closeFds(reply.fds)
+		}
+		return nil, channel.Err()
+	case <-ctx.Done():
+		if reply := channel.forgetQuery(msg.hdr.Id, wait, true); reply != nil {
+			return channel.replyResult(reply)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+// replyResult turns an error reply into a RemoteError.
+func (channel *Channel) replyResult(reply *IPCMessage) (*IPCMessage, error) {
+	if reply.hdr.Kind != IPCMSG_KIND_ERROR {
+		return reply, nil
+	}
+	closeFds(reply.fds)
+	var remote RemoteError
+	if err := reply.TryUnmarshal(&remote); err != nil {
+		return nil, channel.errorf("error reply: %w", ErrMalformedMessage)
+	}
+	return nil, channel.errorf("%w", &remote)
+}
+
+// forgetQuery removes a pending query, remembering its id if a reply may still
+// come. if the reply raced us and is already there, it is returned.
+func (channel *Channel) forgetQuery(id uuid.UUID, wait chan *IPCMessage, sent bool) *IPCMessage {
+	channel.muQueries.Lock()
+	if _, exists := channel.queries[id]; !exists {
+		// the reader already took it, the reply is in flight to us
+		channel.muQueries.Unlock()
+		return <-wait
+	}
+	defer channel.muQueries.Unlock()
+	delete(channel.queries, id)
+	if sent {
+		// a peer that never replies must not make us remember forever,
+		// the oldest are forgotten and their replies dropped if they come
+		for len(channel.abandonOrd) >= IPCMSG_MAX_ABANDONED {
+			delete(channel.abandoned, channel.abandonOrd[0])
+			channel.abandonOrd = channel.abandonOrd[1:]
+		}
+		channel.abandoned[id] = struct{}{}
+		channel.abandonOrd = append(channel.abandonOrd, id)
+	}
+	return nil
+}
+
+// OnLateReply registers a hook receiving replies to queries that were given up,
+// it is called from the reader goroutine and should not block.
+func (channel *Channel) OnLateReply(hook func(*IPCMessage)) {
+	channel.muQueries.Lock()
+	defer channel.muQueries.Unlock()
+	channel.onLateReply = hook
 }
 
 func (channel *Channel) ChannelIn() <-chan *IPCMessage {
@@ -341,9 +1109,31 @@ func (msg *IPCMessage) Type() IPCMsgType {
 	return msg.hdr.Type
 }
 
-func (msg *IPCMessage) TryUnmarshal(v interface{}) error {
-	dec := gob.NewDecoder(bytes.NewBuffer(msg.data))
-	return dec.Decode(v)
+func (msg *IPCMessage) Kind() IPCMsgKind {
+	return msg.hdr.Kind
+}
+
+// TryUnmarshal decodes the payload with the codec it was encoded with.
+// the payload comes from the peer, a codec choking on it returns an error.
+func (msg *IPCMessage) TryUnmarshal(v interface{}) (err error) {
+	codec, err := lookupCodec(msg.hdr.Codec)
+	if err != nil {
+		return err
+	}
+
+	// messages we created ourselves have no channel and are trusted
+	if _, raw := codec.(RawCodec); !raw && msg.channel != nil {
+		if max := msg.channel.MaxDecodeSize(); len(msg.data) > max {
+			return fmt.Errorf("codec %d: %d bytes: %w", msg.hdr.Codec, len(msg.data), ErrMessageTooLarge)
+		}
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: codec %d: %v", ErrMalformedMessage, msg.hdr.Codec, r)
+		}
+	}()
+	return codec.Unmarshal(msg.data, v)
 }
 
 func (msg *IPCMessage) Unmarshal(v interface{}) {
@@ -354,15 +1144,64 @@ func (msg *IPCMessage) Unmarshal(v interface{}) {
 }
 
 func (msg *IPCMessage) HasFd() bool {
-	return msg.hdr.HasFd == 1
+	return msg.hdr.NumFds != 0
 }
 
+// Fd returns the first FD attached to the message, or -1 if there's none.
 func (msg *IPCMessage) Fd() int {
-	return msg.fd
+	if len(msg.fds) == 0 {
+		return -1
+	}
+	return msg.fds[0]
+}
+
+// Fds returns the FDs attached to the message, in the order they were passed,
+// an FD that was lost in transit is -1.
+func (msg *IPCMessage) Fds() []int {
+	return msg.fds
+}
+
+func (msg *IPCMessage) Reply(msgtype IPCMsgType, data interface{}, fd int) error {
+	return msg.ReplyFds(msgtype, data, fdList(fd))
+}
+
+// ReplyFds is like Reply but attaches several FDs in one go.
+func (msg *IPCMessage) ReplyFds(msgtype IPCMsgType, data interface{}, fds []int) error {
+	reply, err := createReply(*msg, msgtype, data, fds)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt32(&msg.replied, 1)
+	return msg.channel.write(context.Background(), reply)
+}
+
+// ReplyError answers a request with an error, the query on the other end
+// fails with a RemoteError holding its message, its code and errno.
+func (msg *IPCMessage) ReplyError(err error) error {
+	reply, cerr := createReply(*msg, IPCMSG_ERROR, newRemoteError(err), nil)
+	if cerr != nil {
+		return cerr
+	}
+	atomic.StoreInt32(&msg.replied, 1)
+	reply.hdr.Kind = IPCMSG_KIND_ERROR
+	return msg.channel.write(context.Background(), reply)
+}
+
+// Channel returns the channel msg was received on.
+func (msg *IPCMessage) Channel() *Channel {
+	return msg.channel
+}
+
+// Query sends a query on the channel msg was received on, from within the
+// handler of msg: while it waits for the reply, Dispatch() goes on with the
+// next messages as the peer may need one of them handled before it replies.
+func (msg *IPCMessage) Query(msgtype IPCMsgType, data interface{}, fd int) (*IPCMessage, error) {
+	return msg.QueryContext(context.Background(), msgtype, data, fd)
 }
 
-func (msg *IPCMessage) Reply(msgtype IPCMsgType, data interface{}, fd int) {
-	msg.channel.w <- createReply(*msg, msgtype, data, fd)
+// QueryContext is like Query but waits for the reply until ctx is done.
+func (msg *IPCMessage) QueryContext(ctx context.Context, msgtype IPCMsgType, data interface{}, fd int) (*IPCMessage, error) {
+	return msg.channel.queryFrom(ctx, msg, msgtype, data, fdList(fd))
 }
 
 func (msg *IPCMessage) OneOf(msgtypes ...IPCMsgType) *IPCMessage {
@@ -1,8 +1,2039 @@
 package ipcmsg
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
+
+	"github.com/google/uuid"
 )
 
+var (
+	testMsgPing = NewIPCMsgType("")
+	testMsgPong = NewIPCMsgType("")
+	testMsgRaw  = NewIPCMsgType([]byte{})
+
+	testMsgExplicit = NewIPCMsgTypeID(0x10000, "TEST_EXPLICIT", "")
+	testMsgNamed    = NewIPCMsgTypeName("TEST_NAMED", 0)
+)
+
+func init() {
+	SetTypeCodec(testMsgRaw, RawCodec{})
+}
+
+// spawned children re-execute the test binary, they are dispatched here
+func TestMain(m *testing.M) {
+	switch Role() {
+	case "":
+		os.Exit(m.Run())
+	case "echo":
+		channel, err := ChildChannel()
+		if err != nil {
+			os.Exit(1)
+		}
+		channel.Handler(testMsgPing, func(msg *IPCMessage) {
+			var data string
+			msg.Unmarshal(&data)
+			msg.Reply(testMsgPong, data, -1)
+		})
+		<-channel.Dispatch()
+		os.Exit(0)
+	case "crash":
+		os.Exit(3)
+	case "hang":
+		// never looks at its channel
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	}
+	os.Exit(1)
+}
+
+func socketpair(t *testing.T) (int, int) {
+	t.Helper()
+	sp, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_STREAM, syscall.AF_UNSPEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sp[0], sp[1]
+}
+
 func TestIPCMsg(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		msg.Reply(testMsgPong, data+" PONG", -1)
+	})
+	child.Dispatch()
+	parent.Dispatch()
+
+	reply, err := parent.Query(testMsgPing, "PING", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	reply.OneOf(testMsgPong).Unmarshal(&data)
+	if data != "PING PONG" {
+		t.Fatalf("unexpected reply: %q", data)
+	}
+}
+
+func TestTryNewChannelNotSocket(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	if _, err := TryNewChannel("pipe", os.Getpid(), int(r.Fd())); err == nil {
+		t.Fatal("expected an error on a non-socket fd")
+	}
+}
+
+func TestChannelFailsOnUnexpectedType(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	hooked := make(chan error, 1)
+	child.OnError(func(err error) { hooked <- err })
+	done := child.Dispatch()
+
+	if err := parent.Message(testMsgPing, "PING", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case err := <-hooked:
+		if !errors.Is(err, ErrUnexpectedType) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnError hook not called")
+	}
+	<-done
+
+	if !errors.Is(child.Err(), ErrUnexpectedType) {
+		t.Fatalf("unexpected Err(): %v", child.Err())
+	}
+	if err := child.Message(testMsgPong, "PONG", -1); !errors.Is(err, ErrUnexpectedType) {
+		t.Fatalf("Message on failed channel returned %v", err)
+	}
+}
+
+func TestQueryContextTimeout(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	release := make(chan struct{})
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		<-release
+		msg.Reply(testMsgPong, "PONG", -1)
+	})
+	child.Dispatch()
+
+	late := make(chan *IPCMessage, 1)
+	parent.Handler(testMsgPong, func(msg *IPCMessage) {
+		t.Error("late reply reached a handler")
+	})
+	parent.OnLateReply(func(msg *IPCMessage) { late <- msg })
+	parent.Dispatch()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := parent.QueryContext(ctx, testMsgPing, "PING", -1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	parent.muQueries.Lock()
+	pending := len(parent.queries)
+	parent.muQueries.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d queries still pending", pending)
+	}
+
+	close(release)
+	select {
+	case msg := <-late:
+		if msg.Type() != testMsgPong {
+			t.Fatalf("unexpected late reply type %d", msg.Type())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("late reply not reported")
+	}
+}
+
+func TestAbandonedQueriesBounded(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	// queries given up on a peer that never replies
+	var first uuid.UUID
+	for i := 0; i < IPCMSG_MAX_ABANDONED+10; i++ {
+		id := uuid.New()
+		if i == 0 {
+			first = id
+		}
+		wait := make(chan *IPCMessage, 1)
+		parent.muQueries.Lock()
+		parent.queries[id] = wait
+		parent.muQueries.Unlock()
+		parent.forgetQuery(id, wait, true)
+	}
+
+	parent.muQueries.Lock()
+	defer parent.muQueries.Unlock()
+	if len(parent.abandoned) != IPCMSG_MAX_ABANDONED || len(parent.abandonOrd) != IPCMSG_MAX_ABANDONED {
+		t.Fatalf("%d abandoned queries remembered", len(parent.abandoned))
+	}
+	if _, exists := parent.abandoned[first]; exists {
+		t.Fatal("oldest abandoned query not forgotten")
+	}
+}
+
+func TestClose(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer child.Close()
+
+	// the query is left unanswered until the parent is closed
+	release := make(chan struct{})
+	defer close(release)
+
+	received := make(chan string, 2)
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		received <- data
+		if msg.Kind() == IPCMSG_KIND_REQUEST {
+			<-release
+		}
+	})
+	child.Dispatch()
+	done := parent.Dispatch()
+
+	queryErr := make(chan error, 1)
+	go func() {
+		_, err := parent.Query(testMsgPing, "query", -1)
+		queryErr <- err
+	}()
+	if err := parent.Message(testMsgPing, "message", -1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not flushed")
+		}
+	}
+
+	if err := parent.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-queryErr; !errors.Is(err, ErrClosed) {
+		t.Fatalf("pending query returned %v", err)
+	}
+	<-done
+	if _, ok := <-parent.ChannelIn(); ok {
+		t.Fatal("ChannelIn not closed")
+	}
+	if err := parent.Message(testMsgPing, "late", -1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Message after Close returned %v", err)
+	}
+	if err := parent.Close(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("second Close returned %v", err)
+	}
+}
+
+func TestPeerClosed(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+
+	// the child goes away instead of answering
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		child.Close()
+	})
+	child.Dispatch()
+	parent.Dispatch()
+
+	disconnected := make(chan error, 1)
+	parent.OnDisconnect(func(err error) {
+		disconnected <- err
+	})
+
+	if _, err := parent.Query(testMsgPing, "ping", -1); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("pending query returned %v", err)
+	}
+	select {
+	case <-parent.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done not closed")
+	}
+	if err := <-disconnected; !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("OnDisconnect called with %v", err)
+	}
+	if err := parent.Message(testMsgPing, "ping", -1); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("Message returned %v", err)
+	}
+}
+
+func TestMessageKinds(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	kinds := make(chan IPCMsgKind, 1)
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		switch data {
+		case "notify":
+			kinds <- msg.Kind()
+		case "answer":
+			msg.Reply(testMsgPong, data, -1)
+		case "fail":
+			msg.ReplyError(errors.New("no can do"))
+		}
+		// anything else is left unanswered
+	})
+	child.Dispatch()
+	parent.Handler(testMsgPong, func(msg *IPCMessage) {
+		t.Error("reply reached a handler")
+	})
+	parent.Dispatch()
+
+	parent.Message(testMsgPing, "notify", -1)
+	if kind := <-kinds; kind != IPCMSG_KIND_NOTIFY {
+		t.Fatalf("message received as %v", kind)
+	}
+
+	reply, err := parent.Query(testMsgPing, "answer", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Kind() != IPCMSG_KIND_REPLY {
+		t.Fatalf("reply received as %v", reply.Kind())
+	}
+
+	var remote *RemoteError
+	if _, err := parent.Query(testMsgPing, "fail", -1); !errors.As(err, &remote) || remote.Message != "no can do" {
+		t.Fatalf("query answered with an error returned %v", err)
+	}
+	if _, err := parent.Query(testMsgPing, "ignore", -1); !errors.Is(err, ErrNoReply) {
+		t.Fatalf("unanswered query returned %v", err)
+	}
+
+	// a reply nobody asked for is dropped
+	stray, err := createReply(IPCMessage{channel: child}, testMsgPong, "stray", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := child.write(context.Background(), stray); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parent.Query(testMsgPing, "answer", -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := parent.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type testCodedError struct{}
+
+func (testCodedError) Error() string {
+	return "coded"
+}
+
+func (testCodedError) ErrorCode() int {
+	return IPCMSG_ERR_USER + 1
+}
+
+func TestQueryHandler(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	child.QueryHandler(testMsgPing, testMsgPong, func(msg *IPCMessage) (interface{}, int, error) {
+		var data string
+		msg.Unmarshal(&data)
+		switch data {
+		case "missing":
+			_, err := os.Open(filepath.Join(t.TempDir(), "missing"))
+			return nil, -1, err
+		case "denied":
+			return nil, -1, fmt.Errorf("denied: %w", fs.ErrPermission)
+		case "coded":
+			return nil, -1, testCodedError{}
+		}
+		return "pong", -1, nil
+	})
+	child.Dispatch()
+	parent.Dispatch()
+
+	reply, err := parent.Query(testMsgPing, "ping", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	reply.Unmarshal(&data)
+	if data != "pong" {
+		t.Fatalf("unexpected reply %q", data)
+	}
+
+	var remote *RemoteError
+	_, err = parent.Query(testMsgPing, "missing", -1)
+	if !errors.Is(err, fs.ErrNotExist) || !errors.Is(err, syscall.ENOENT) || errors.Is(err, fs.ErrPermission) {
+		t.Fatalf("failed open returned %v", err)
+	}
+	if !errors.As(err, &remote) || remote.Errno != syscall.ENOENT || !strings.Contains(remote.Message, "missing") {
+		t.Fatalf("failed open returned %#v", remote)
+	}
+
+	_, err = parent.Query(testMsgPing, "denied", -1)
+	if !errors.Is(err, fs.ErrPermission) || !errors.As(err, &remote) || remote.Errno != 0 {
+		t.Fatalf("denied query returned %v", err)
+	}
+
+	_, err = parent.Query(testMsgPing, "coded", -1)
+	if !errors.As(err, &remote) || remote.Code != IPCMSG_ERR_USER+1 {
+		t.Fatalf("coded error returned %v", err)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	panics := make(chan error, 2)
+	child.OnError(func(err error) { panics <- err })
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		if data == "boom" {
+			msg.OneOf(testMsgPong)
+		}
+		msg.Reply(testMsgPong, data, -1)
+	})
+	child.Dispatch()
+	parent.Dispatch()
+
+	if _, err := parent.Query(testMsgPing, "boom", -1); !errors.Is(err, ErrHandlerPanic) {
+		t.Fatalf("query to a panicking handler returned %v", err)
+	}
+	parent.Message(testMsgPing, "boom", -1)
+	for i := 0; i < 2; i++ {
+		var panicErr *PanicError
+		if err := <-panics; !errors.As(err, &panicErr) || panicErr.Type != testMsgPing || len(panicErr.Stack) == 0 {
+			t.Fatalf("panic reported as %v", err)
+		}
+	}
+
+	// and the child keeps serving
+	if _, err := parent.Query(testMsgPing, "ping", -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNestedQuery(t *testing.T) {
+	testNestedQuery(t, DispatchConfig{})
+}
+
+func TestNestedQueryPool(t *testing.T) {
+	// a single worker, held by the handler waiting for its reply
+	testNestedQuery(t, DispatchConfig{Mode: IPCMSG_DISPATCH_POOL, Workers: 1})
+}
+
+func testNestedQuery(t *testing.T, config DispatchConfig) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+	parent.SetDispatch(config)
+	child.SetDispatch(config)
+
+	// lookup -> ask -> detail, each answered by querying the other end
+	// from within the handler of the previous one
+	nested := func(next map[string]string) func(*IPCMessage) (interface{}, int, error) {
+		return func(msg *IPCMessage) (interface{}, int, error) {
+			var data string
+			msg.Unmarshal(&data)
+			query, exists := next[data]
+			if !exists {
+				return data, -1, nil
+			}
+			reply, err := msg.Query(testMsgPing, query, -1)
+			if err != nil {
+				return nil, -1, err
+			}
+			var answer string
+			reply.Unmarshal(&answer)
+			return data + "/" + answer, -1, nil
+		}
+	}
+	child.QueryHandler(testMsgPing, testMsgPong, nested(map[string]string{"lookup": "ask"}))
+	parent.QueryHandler(testMsgPing, testMsgPong, nested(map[string]string{"ask": "detail"}))
+	child.Dispatch()
+	parent.Dispatch()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := parent.QueryContext(ctx, testMsgPing, "lookup", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	reply.Unmarshal(&data)
+	if data != "lookup/ask/detail" {
+		t.Fatalf("unexpected reply %q", data)
+	}
+
+	// dispatching goes on one message at a time afterwards
+	for i := 0; i < 3; i++ {
+		if _, err := parent.Query(testMsgPing, "lookup", -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestDispatchTwice(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer child.Close()
+
+	var handled []string
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		handled = append(handled, data)
+	})
+	d1 := child.Dispatch()
+	d2 := child.Dispatch()
+
+	var want []string
+	for i := 0; i < 10; i++ {
+		want = append(want, fmt.Sprint(i))
+		parent.Message(testMsgPing, want[i], -1)
+	}
+	parent.Close()
+
+	for _, done := range []<-chan bool{d1, d2} {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Dispatch() end not signaled")
+		}
+	}
+	if strings.Join(handled, ",") != strings.Join(want, ",") {
+		t.Fatalf("handled out of order: %v", handled)
+	}
+}
+
+func TestDispatchPoolTwice(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	handled := make(chan struct{}, 2)
+	release := make(chan struct{})
+	child.SetDispatch(DispatchConfig{Mode: IPCMSG_DISPATCH_POOL, Workers: 1})
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		<-release
+		handled <- struct{}{}
+	})
+	child.Dispatch()
+
+	// the second message waits for the worker held by the first
+	parent.Message(testMsgPing, "first", -1)
+	parent.Message(testMsgPing, "second", -1)
+	time.Sleep(50 * time.Millisecond)
+	child.Dispatch()
+	close(release)
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-handled:
+		case <-time.After(5 * time.Second):
+			t.Fatal("waiting message not handled")
+		}
+	}
+}
+
+func TestQueryOutsideHandler(t *testing.T) {
+	testQueryOutsideHandler(t, DispatchConfig{})
+}
+
+func TestQueryOutsideHandlerPool(t *testing.T) {
+	testQueryOutsideHandler(t, DispatchConfig{Mode: IPCMSG_DISPATCH_POOL, Workers: 1})
+}
+
+// queries made while a handler runs, but not from it, leave dispatching alone
+func testQueryOutsideHandler(t *testing.T, config DispatchConfig) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+	child.SetDispatch(config)
+
+	var running, overlapped int32
+	handled := make(chan string, 3)
+	release := make(chan struct{})
+	started := make(chan struct{}, 1)
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		if atomic.AddInt32(&running, 1) != 1 {
+			atomic.StoreInt32(&overlapped, 1)
+		}
+		var data string
+		msg.Unmarshal(&data)
+		if data == "slow" {
+			started <- struct{}{}
+			<-release
+		}
+		atomic.AddInt32(&running, -1)
+		handled <- data
+	})
+	child.Dispatch()
+	parent.QueryHandler(testMsgPong, testMsgPong, func(msg *IPCMessage) (interface{}, int, error) {
+		return "pong", -1, nil
+	})
+	parent.Dispatch()
+
+	parent.Message(testMsgPing, "slow", -1)
+	<-started
+	if _, err := child.Query(testMsgPong, "unrelated", -1); err != nil {
+		t.Fatal(err)
+	}
+	parent.Message(testMsgPing, "next", -1)
+	select {
+	case data := <-handled:
+		t.Fatalf("%s handled while a handler runs", data)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	parent.Message(testMsgPing, "last", -1)
+	var order []string
+	for i := 0; i < 3; i++ {
+		select {
+		case data := <-handled:
+			order = append(order, data)
+		case <-time.After(5 * time.Second):
+			t.Fatal("messages not handled")
+		}
+	}
+	if atomic.LoadInt32(&overlapped) != 0 {
+		t.Fatal("handlers overlapped")
+	}
+	if config.Mode == IPCMSG_DISPATCH_SERIAL && strings.Join(order, ",") != "slow,next,last" {
+		t.Fatalf("handled out of order: %v", order)
+	}
+}
+
+// a query from a handler gets its reply past a message the peer sent first
+func TestQueryFromHandler(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		child.Message(testMsgRaw, []byte("before"), -1)
+		msg.Reply(testMsgPong, "pong", -1)
+	})
+	Handle(child, testMsgAdd, func(req testRequest, msg *IPCMessage) {
+		child.Message(testMsgRaw, []byte("before"), -1)
+		Reply(msg, testMsgResult, testResponse{Sum: req.A + req.B})
+	})
+	child.Dispatch()
+
+	results := make(chan error, 2)
+	notified := make(chan struct{}, 2)
+	parent.Handler(testMsgRaw, func(msg *IPCMessage) {
+		notified <- struct{}{}
+	})
+	parent.Handler(testMsgExplicit, func(msg *IPCMessage) {
+		_, err := parent.Query(testMsgPing, "ping", -1)
+		results <- err
+		_, _, err = Call[testRequest, testResponse](context.Background(), parent, testMsgAdd, testRequest{A: 1, B: 2})
+		results <- err
+	})
+	parent.Dispatch()
+
+	child.Message(testMsgExplicit, "go", -1)
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-results:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("query stuck behind a notification")
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-notified:
+		case <-time.After(5 * time.Second):
+			t.Fatal("notification not handled")
+		}
+	}
+}
+
+func TestDispatchPool(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	started := make(chan struct{}, 4)
+	release := make(chan struct{})
+	child.SetDispatch(DispatchConfig{Mode: IPCMSG_DISPATCH_POOL, Workers: 4})
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		started <- struct{}{}
+		<-release
+	})
+	child.Dispatch()
+
+	for i := 0; i < 4; i++ {
+		parent.Message(testMsgPing, "slow", -1)
+	}
+	for i := 0; i < 4; i++ {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d handlers running at once", i)
+		}
+	}
+	close(release)
+}
+
+func TestDispatchKeyed(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	var mu sync.Mutex
+	taken := 0
+	handled := make(map[string][]string)
+	child.SetDispatch(DispatchConfig{
+		Mode:        IPCMSG_DISPATCH_KEYED,
+		MaxInFlight: 4,
+		Key: func(msg *IPCMessage) interface{} {
+			mu.Lock()
+			taken++
+			mu.Unlock()
+			var data string
+			msg.Unmarshal(&data)
+			return data[:1]
+		},
+	})
+
+	release := make(chan struct{})
+	bStarted := make(chan struct{})
+	all := make(chan struct{}, 20)
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		switch data {
+		case "a0":
+			// b is handled while a is held up
+			select {
+			case <-bStarted:
+			case <-time.After(5 * time.Second):
+				t.Error("keys not handled concurrently")
+			}
+			<-release
+		case "b0":
+			close(bStarted)
+		}
+		mu.Lock()
+		handled[data[:1]] = append(handled[data[:1]], data)
+		mu.Unlock()
+		all <- struct{}{}
+	})
+	child.Dispatch()
+
+	for i := 0; i < 10; i++ {
+		parent.Message(testMsgPing, fmt.Sprintf("a%d", i), -1)
+		parent.Message(testMsgPing, fmt.Sprintf("b%d", i), -1)
+	}
+
+	// a0 is held up and a1 to a3 pile up behind it, taking all the slots:
+	// nothing is taken in past b2 until a0 is released
+	<-bStarted
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	if taken != 7 {
+		t.Errorf("%d messages taken in for 4 slots", taken)
+	}
+	mu.Unlock()
+
+	close(release)
+	for i := 0; i < 20; i++ {
+		select {
+		case <-all:
+		case <-time.After(5 * time.Second):
+			t.Fatal("messages not handled")
+		}
+	}
+	for key, order := range handled {
+		for i, data := range order {
+			if data != fmt.Sprintf("%s%d", key, i) {
+				t.Fatalf("key %s handled out of order: %v", key, order)
+			}
+		}
+	}
+}
+
+func TestCloseStuckPeer(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer child.Close()
+
+	// the child never dispatches, once its queue is full the writer
+	// ends up stuck
+	payload := make([]byte, 256*1024)
+	for i := 0; i < 2*IPCMSG_MAX_QUEUED; i++ {
+		go parent.Message(testMsgRaw, payload, -1)
+	}
+	for len(child.ChannelIn()) != IPCMSG_MAX_QUEUED {
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- parent.closeWithin(100 * time.Millisecond)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close held up by the peer")
+	}
+	if err := parent.Message(testMsgRaw, payload, -1); !errors.Is(err, ErrClosed) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(parent.Err(), context.DeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", parent.Err())
+	}
+}
+
+func TestCloseFromHook(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+
+	closed := make(chan error, 2)
+	parent.OnError(func(err error) {
+		closed <- parent.Close()
+	})
+	parent.OnDisconnect(func(err error) {
+		closed <- parent.Close()
+	})
+	parent.Dispatch()
+	child.Close()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-closed:
+			if err != nil && !errors.Is(err, ErrClosed) {
+				t.Fatalf("Close from a hook returned %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close from a hook deadlocked")
+		}
+	}
+}
+
+func TestStreamReassembly(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer child.Close()
+	defer syscall.Close(fd0)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	wfd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	first, err := createMessage(GobCodec{}, testMsgPing, "with fd", []int{wfd})
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := createMessage(GobCodec{}, testMsgPing, "without fd", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame1, _ := encodeMessage(first)
+	frame2, _ := encodeMessage(second)
+
+	// the fd goes along the first byte, then everything trickles byte by byte
+	if err := syscall.Sendmsg(fd0, frame1[:1], syscall.UnixRights(wfd), nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	syscall.Close(wfd)
+	go func() {
+		for _, b := range append(frame1[1:], frame2...) {
+			syscall.Write(fd0, []byte{b})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for _, expected := range []string{"with fd", "without fd"} {
+		select {
+		case msg := <-child.ChannelIn():
+			var data string
+			msg.Unmarshal(&data)
+			if data != expected {
+				t.Fatalf("got %q, expected %q", data, expected)
+			}
+			if msg.HasFd() != (msg.Fd() != -1) {
+				t.Fatalf("%q: HasFd %v but fd %d", data, msg.HasFd(), msg.Fd())
+			}
+			if msg.HasFd() {
+				syscall.Write(msg.Fd(), []byte("ok"))
+				syscall.Close(msg.Fd())
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("message not reassembled")
+		}
+	}
+
+	buf := make([]byte, 2)
+	if n, _ := r.Read(buf); string(buf[:n]) != "ok" {
+		t.Fatal("received fd is not the one sent")
+	}
+}
+
+func TestLargeMessage(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	large := strings.Repeat("x", 1024*1024)
+	child.SetMaxDecodeSize(2 * len(large))
+	go parent.Message(testMsgPing, large, -1)
+
+	select {
+	case msg := <-child.ChannelIn():
+		var data string
+		msg.Unmarshal(&data)
+		if data != large {
+			t.Fatalf("received %d bytes, expected %d", len(data), len(large))
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("large message not received")
+	}
+
+	parent.SetMaxMessageSize(1024)
+	if err := parent.Message(testMsgPing, large, -1); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := parent.Err(); err != nil {
+		t.Fatalf("channel failed: %v", err)
+	}
+}
+
+func TestMessageFds(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	readers := make([]*os.File, 3)
+	fds := make([]int, 3)
+	for i := range fds {
+		r, w, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		readers[i] = r
+		fds[i], _ = syscall.Dup(int(w.Fd()))
+		w.Close()
+	}
+
+	go parent.MessageFds(testMsgPing, "fds", fds)
+
+	select {
+	case msg := <-child.ChannelIn():
+		if len(msg.Fds()) != 3 {
+			t.Fatalf("received %d fds", len(msg.Fds()))
+		}
+		for i, fd := range msg.Fds() {
+			// they must not leak into spawned children
+			if flags, _, _ := syscall.Syscall(syscall.SYS_FCNTL, uintptr(fd), syscall.F_GETFD, 0); flags&syscall.FD_CLOEXEC == 0 {
+				t.Errorf("fd #%d received without close-on-exec", i)
+			}
+			syscall.Write(fd, []byte{byte('a' + i)})
+			syscall.Close(fd)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("message not received")
+	}
+
+	for i, r := range readers {
+		buf := make([]byte, 1)
+		if n, _ := r.Read(buf); n != 1 || buf[0] != byte('a'+i) {
+			t.Fatalf("fd #%d out of order", i)
+		}
+	}
+
+	parent.SetMaxFds(2)
+	if err := parent.MessageFds(testMsgPing, "fds", []int{0, 1, 2}); !errors.Is(err, ErrTooManyFds) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestSeqpacket(t *testing.T) {
+	sp, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_SEQPACKET, syscall.AF_UNSPEC)
+	if err != nil {
+		t.Skip(err)
+	}
+	parent := NewChannel("parent", os.Getpid(), sp[0])
+	child := NewChannel("child", os.Getpid(), sp[1])
+	defer parent.Close()
+	defer child.Close()
+
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		msg.ReplyFds(testMsgPong, data, msg.Fds())
+	})
+	child.Dispatch()
+	parent.Dispatch()
+
+	fd, _ := syscall.Dup(0)
+	reply, err := parent.Query(testMsgPing, "PING", fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply.Fds()) != 1 || reply.Fd() == -1 {
+		t.Fatalf("unexpected fds %v", reply.Fds())
+	}
+	syscall.Close(reply.Fd())
+
+}
+
+func TestDgram(t *testing.T) {
+	sp, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_DGRAM, syscall.AF_UNSPEC)
+	if err != nil {
+		t.Skip(err)
+	}
+	parent := NewChannel("parent", os.Getpid(), sp[0])
+	child := NewChannel("child", os.Getpid(), sp[1])
+	defer parent.Close()
+
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		msg.Reply(testMsgPong, data, -1)
+	})
+	child.Dispatch()
+	parent.Dispatch()
+
+	reply, err := parent.Query(testMsgPing, "PING", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data string
+	reply.Unmarshal(&data)
+	if data != "PING" {
+		t.Fatalf("unexpected reply %q", data)
+	}
+
+	// the peer going away goes unnoticed but for the keepalive
+	child.Close()
+	parent.SetKeepalive(10*time.Millisecond, 3)
+	select {
+	case <-parent.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("closed peer not noticed")
+	}
+}
+
+func TestDgramEmpty(t *testing.T) {
+	sp, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_DGRAM, syscall.AF_UNSPEC)
+	if err != nil {
+		t.Skip(err)
+	}
+	parent := NewChannel("parent", os.Getpid(), sp[0])
+	defer parent.Close()
+	defer syscall.Close(sp[1])
+
+	// an empty datagram is not the peer going away
+	if _, err := syscall.Write(sp[1], nil); err != nil {
+		t.Fatal(err)
+	}
+	<-parent.Done()
+	if err := parent.Err(); !errors.Is(err, ErrShortMessage) {
+		t.Fatalf("empty datagram failed the channel with %v", err)
+	}
+}
+
+func TestSeqpacketTruncated(t *testing.T) {
+	sp, err := syscall.Socketpair(syscall.AF_LOCAL, syscall.SOCK_SEQPACKET, syscall.AF_UNSPEC)
+	if err != nil {
+		t.Skip(err)
+	}
+	parent := NewChannel("parent", os.Getpid(), sp[0])
+	child := NewChannel("child", os.Getpid(), sp[1])
+	defer parent.Close()
+	defer child.Close()
+
+	// the reader is already waiting with a large buffer, the first
+	// record makes it pick up the new maximum size for the next one
+	child.SetMaxMessageSize(16)
+	parent.Message(testMsgPing, "", -1)
+	parent.Message(testMsgPing, strings.Repeat("x", 64), -1)
+
+	<-child.ChannelIn()
+	select {
+	case _, ok := <-child.ChannelIn():
+		if ok {
+			t.Fatal("truncated record delivered")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel did not fail")
+	}
+	if !errors.Is(child.Err(), ErrTruncated) {
+		t.Fatalf("unexpected error: %v", child.Err())
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	defer parent.Close()
+	defer syscall.Close(fd1)
+
+	// nobody reads on the other end, the socket buffer eventually fills up
+	parent.SetWriteTimeout(50 * time.Millisecond)
+	large := strings.Repeat("x", 64*1024)
+	for i := 0; i < 1024; i++ {
+		if err := parent.Message(testMsgPing, large, -1); err != nil {
+			break
+		}
+	}
+
+	select {
+	case <-parent.ChannelIn():
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel did not fail")
+	}
+	if !errors.Is(parent.Err(), os.ErrDeadlineExceeded) {
+		t.Fatalf("unexpected error: %v", parent.Err())
+	}
+}
+
+func TestCodecs(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	parent.SetCodec(JSONCodec{})
+	go func() {
+		parent.Message(testMsgPing, "json", -1)
+		parent.Message(testMsgRaw, []byte("raw"), -1)
+	}()
+
+	msg := <-child.ChannelIn()
+	if string(msg.data) != `"json"` {
+		t.Fatalf("payload not JSON encoded: %q", msg.data)
+	}
+	var data string
+	msg.Unmarshal(&data)
+	if data != "json" {
+		t.Fatalf("unexpected payload %q", data)
+	}
+
+	msg = <-child.ChannelIn()
+	if string(msg.data) != "raw" {
+		t.Fatalf("payload not passed through: %q", msg.data)
+	}
+	var raw []byte
+	msg.Unmarshal(&raw)
+	if string(raw) != "raw" {
+		t.Fatalf("unexpected payload %q", raw)
+	}
+}
+
+func TestBinaryCodec(t *testing.T) {
+	type point struct {
+		X, Y int32
+	}
+	codec := BinaryCodec{}
+	data, err := codec.Marshal(point{1, -2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 8 {
+		t.Fatalf("unexpected encoding size %d", len(data))
+	}
+	var p point
+	if err := codec.Unmarshal(data, &p); err != nil || p != (point{1, -2}) {
+		t.Fatalf("unexpected decoding %v (%v)", p, err)
+	}
+}
+
+func TestMsgTypeRegistration(t *testing.T) {
+	if testMsgExplicit != 0x10000 {
+		t.Fatalf("unexpected id %d", testMsgExplicit)
+	}
+
+	name, goType, exists := LookupIPCMsgType(testMsgNamed)
+	if !exists || name != "TEST_NAMED" || goType.Kind() != reflect.Int {
+		t.Fatalf("unexpected lookup: %q %v %v", name, goType, exists)
+	}
+	if testMsgNamed.String() != "TEST_NAMED" {
+		t.Fatalf("unexpected String(): %s", testMsgNamed)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("duplicate id not detected")
+		}
+	}()
+	NewIPCMsgTypeID(0x10000, "TEST_DUPLICATE", "")
+}
+
+type testRequest struct {
+	A, B int
+}
+
+type testResponse struct {
+	Sum int
+}
+
+var (
+	testMsgAdd    = Register[testRequest](0x20000, "TEST_ADD")
+	testMsgResult = Register[testResponse](0x20001, "TEST_RESULT")
+)
+
+func TestGenerics(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	Handle(child, testMsgAdd, func(req testRequest, msg *IPCMessage) {
+		Reply(msg, testMsgResult, testResponse{Sum: req.A + req.B})
+	})
+	child.Dispatch()
+	parent.Dispatch()
+
+	resp, _, err := Call[testRequest, testResponse](context.Background(), parent, testMsgAdd, testRequest{A: 40, B: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Sum != 42 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// a payload that doesn't decode is answered with an error
+	reported := make(chan error, 1)
+	child.OnError(func(err error) { reported <- err })
+	bad, err := createMessage(GobCodec{}, IPCMsgType(testMsgAdd), testRequest{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.data = []byte("garbage")
+	bad.hdr.Size = uint32(len(bad.data))
+	bad.hdr.Kind = IPCMSG_KIND_REQUEST
+	wait := make(chan *IPCMessage, 1)
+	parent.muQueries.Lock()
+	parent.queries[bad.hdr.Id] = wait
+	parent.muQueries.Unlock()
+	if err := parent.write(context.Background(), bad); err != nil {
+		t.Fatal(err)
+	}
+	var remote *RemoteError
+	if _, err := parent.replyResult(<-wait); !errors.As(err, &remote) {
+		t.Fatalf("undecodable query answered with %v", err)
+	}
+	if err := <-reported; err == nil || child.Err() != nil {
+		t.Fatalf("undecodable payload reported as %v", err)
+	}
+
+	// and the child keeps serving
+	if _, _, err := Call[testRequest, testResponse](context.Background(), parent, testMsgAdd, testRequest{A: 1, B: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("interface payload type registered")
+		}
+	}()
+	Register[error](0x20002, "TEST_INTERFACE")
+}
+
+func TestMaxDecodeSize(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	// a gob payload over the default limit is not decoded
+	go parent.Message(testMsgPing, strings.Repeat("x", IPCMSG_MAX_DECODE_SIZE), -1)
+	msg := <-child.ChannelIn()
+	var data string
+	if err := msg.TryUnmarshal(&data); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	child.SetMaxDecodeSize(16)
+	parent.Message(testMsgPing, "short", -1)
+	msg = <-child.ChannelIn()
+	if err := msg.TryUnmarshal(&data); err != nil || data != "short" {
+		t.Fatalf("unexpected payload %q: %v", data, err)
+	}
+	parent.Message(testMsgPing, "over sixteen bytes", -1)
+	msg = <-child.ChannelIn()
+	if err := msg.TryUnmarshal(&data); !errors.Is(err, ErrMessageTooLarge) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// raw payloads are only bounded by the maximum message size
+	parent.Message(testMsgRaw, make([]byte, 1024), -1)
+	msg = <-child.ChannelIn()
+	var raw []byte
+	if err := msg.TryUnmarshal(&raw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPeerCred(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	cred, err := parent.PeerCred()
+	if errors.Is(err, ErrNotSupported) {
+		t.Skip(err)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred.Pid != os.Getpid() || cred.Uid != os.Getuid() || cred.Gid != os.Getgid() {
+		t.Fatalf("unexpected credentials %+v", cred)
+	}
+
+	if err := parent.RequirePeer(os.Getpid(), -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.RequirePeer(-1, os.Getuid()+1); !errors.Is(err, ErrPeerMismatch) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !errors.Is(child.Err(), ErrPeerMismatch) {
+		t.Fatalf("channel not failed: %v", child.Err())
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	violations := make(chan error, 2)
+	parent.SetPolicy(&Policy{Allow: map[IPCMsgType]bool{testMsgPing: false}})
+	parent.OnViolation(func(err error) { violations <- err })
+
+	fd, _ := syscall.Dup(0)
+	go func() {
+		child.Message(testMsgPong, "not allowed", -1)
+		child.Message(testMsgPing, "not allowed with fd", fd)
+		child.Message(testMsgPing, "allowed", -1)
+	}()
+
+	msg := <-parent.ChannelIn()
+	var data string
+	msg.Unmarshal(&data)
+	if data != "allowed" {
+		t.Fatalf("unexpected message %q", data)
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-violations; !errors.Is(err, ErrPolicyViolation) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if parent.Violations() != 2 {
+		t.Fatalf("%d violations counted", parent.Violations())
+	}
+
+	parent.SetPolicy(&Policy{Teardown: true})
+	child.Message(testMsgPing, "compromised", -1)
+	if _, ok := <-parent.ChannelIn(); ok {
+		t.Fatal("channel not torn down")
+	}
+	if !errors.Is(parent.Err(), ErrPolicyViolation) {
+		t.Fatalf("unexpected error: %v", parent.Err())
+	}
+}
+
+func TestPolicyErrorReplies(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	// error replies aren't listed, yet queries get them
+	parent.SetPolicy(&Policy{Allow: map[IPCMsgType]bool{testMsgPong: false}, Teardown: true})
+	parent.Dispatch()
+	child.Handler(testMsgPing, func(msg *IPCMessage) {
+		var data string
+		msg.Unmarshal(&data)
+		if data == "fail" {
+			msg.ReplyError(os.ErrNotExist)
+		}
+	})
+	child.Dispatch()
+
+	if _, err := parent.Query(testMsgPing, "fail", -1); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := parent.Query(testMsgPing, "ignore", -1); !errors.Is(err, ErrNoReply) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if parent.Err() != nil {
+		t.Fatal(parent.Err())
+	}
+
+	// an error nobody asked for is still subject to the policy
+	child.Message(IPCMSG_ERROR, RemoteError{Message: "unsolicited"}, -1)
+	select {
+	case <-parent.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("channel not torn down")
+	}
+	if !errors.Is(parent.Err(), ErrPolicyViolation) {
+		t.Fatalf("unexpected error: %v", parent.Err())
+	}
+}
+
+func TestKeepalive(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer parent.Close()
+	defer child.Close()
+
+	// control messages get through even the strictest policy
+	child.SetPolicy(&Policy{Teardown: true})
+	child.Dispatch()
+	parent.Dispatch()
+
+	parent.SetKeepalive(10*time.Millisecond, 3)
+	deadline := time.Now().Add(5 * time.Second)
+	for parent.RTT() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("no pong received")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := parent.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := child.Err(); err != nil {
+		t.Fatal(err)
+	}
+	parent.SetKeepalive(0, 0)
+}
+
+func TestKeepaliveUnresponsive(t *testing.T) {
+	fd0, fd1 := socketpair(t)
+	parent := NewChannel("parent", os.Getpid(), fd0)
+	child := NewChannel("child", os.Getpid(), fd1)
+	defer child.Close()
+
+	// the child never dispatches, as if stuck in a handler
+	parent.Dispatch()
+	disconnected := make(chan error, 1)
+	parent.OnDisconnect(func(err error) {
+		disconnected <- err
+	})
+	parent.SetKeepalive(10*time.Millisecond, 3)
+
+	select {
+	case err := <-disconnected:
+		if !errors.Is(err, ErrPeerUnresponsive) {
+			t.Fatalf("channel failed with %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("unresponsive peer not detected")
+	}
+	<-parent.Done()
+}
+
+func TestListenDial(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+	listener, err := Listen(path, &ListenOptions{Mode: 0600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode()&os.ModeSocket == 0 || info.Mode().Perm() != 0600 {
+		t.Fatalf("unexpected socket mode %v", info.Mode())
+	}
+
+	// a live socket is not taken over
+	if _, err := Listen(path, nil); !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("Listen on a live socket returned %v", err)
+	}
+
+	go func() {
+		for {
+			channel, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			channel.Handler(testMsgPing, func(msg *IPCMessage) {
+				var data string
+				msg.Unmarshal(&data)
+				msg.Reply(testMsgPong, data, -1)
+			})
+			channel.Dispatch()
+		}
+	}()
+
+	for i := 0; i < 2; i++ {
+		client, err := Dial(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Dispatch()
+		if cred, err := client.PeerCred(); err == nil && cred.Pid != os.Getpid() {
+			t.Fatalf("unexpected peer pid %d", cred.Pid)
+		}
+		if _, err := client.Query(testMsgPing, "ping", -1); err != nil {
+			t.Fatal(err)
+		}
+		client.Close()
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Fatal("socket file not removed")
+	}
+	if _, err := listener.Accept(); !errors.Is(err, ErrClosed) {
+		t.Fatalf("Accept after Close returned %v", err)
+	}
+}
+
+func TestListenStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "control.sock")
+
+	// a socket left behind by a process that died
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := Listen(path, &ListenOptions{SocketType: syscall.SOCK_SEQPACKET})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		if channel, err := listener.Accept(); err == nil {
+			channel.Message(testMsgPing, "seqpacket", -1)
+			channel.Close()
+		}
+	}()
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if client.sotype != syscall.SOCK_SEQPACKET {
+		t.Fatalf("unexpected socket type %d", client.sotype)
+	}
+	msg := <-client.ChannelIn()
+	var data string
+	msg.Unmarshal(&data)
+	if data != "seqpacket" {
+		t.Fatalf("unexpected message %q", data)
+	}
+
+	// nor is something else than a socket
+	regular := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(regular, nil, 0600)
+	if _, err := Listen(regular, nil); !errors.Is(err, ErrAddressInUse) {
+		t.Fatalf("Listen on a regular file returned %v", err)
+	}
+}
+
+func TestListenAbstract(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("abstract namespace is Linux only")
+	}
+	path := fmt.Sprintf("@ipcmsg-test-%d", os.Getpid())
+	listener, err := Listen(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	accepted := make(chan *Channel, 1)
+	go func() {
+		channel, _ := listener.Accept()
+		accepted <- channel
+	}()
+	client, err := Dial(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server := <-accepted
+	if server == nil {
+		t.Fatal("Accept failed")
+	}
+	defer server.Close()
+}
+
+func TestServer(t *testing.T) {
+	listener, err := Listen(filepath.Join(t.TempDir(), "control.sock"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(listener)
+	server.MaxClients = 2
+
+	connected := 0
+	server.OnConnect(func(channel *Channel) {
+		connected++
+		channel.SetState(fmt.Sprintf("client %d", connected))
+	})
+	disconnected := make(chan error, 4)
+	server.OnDisconnect(func(channel *Channel, err error) {
+		disconnected <- err
+	})
+	server.Handler(testMsgPing, func(msg *IPCMessage) {
+		msg.Reply(testMsgPong, msg.Channel().State().(string), -1)
+	})
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve()
+	}()
+
+	var clients []*Channel
+	broadcasts := make(chan string, 4)
+	for i := 1; i <= 2; i++ {
+		client, err := Dial(listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Handler(testMsgPing, func(msg *IPCMessage) {
+			var data string
+			msg.Unmarshal(&data)
+			broadcasts <- data
+		})
+		client.Dispatch()
+
+		reply, err := client.Query(testMsgPing, "whoami", -1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data string
+		reply.Unmarshal(&data)
+		if data != fmt.Sprintf("client %d", i) {
+			t.Fatalf("unexpected state %q", data)
+		}
+		clients = append(clients, client)
+	}
+
+	// one client too many
+	extra, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	extra.Dispatch()
+	select {
+	case <-extra.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client beyond MaxClients not disconnected")
+	}
+
+	err = server.Broadcast(testMsgPing, "broadcast", func(channel *Channel) bool {
+		return channel.State() == "client 2"
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := <-broadcasts; data != "broadcast" {
+		t.Fatalf("unexpected broadcast %q", data)
+	}
+	if err := server.Broadcast(testMsgPing, "all", nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if data := <-broadcasts; data != "all" {
+			t.Fatalf("unexpected broadcast %q", data)
+		}
+	}
+
+	clients[0].Close()
+	if err := <-disconnected; !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("client disconnected with %v", err)
+	}
+	if n := len(server.Clients()); n != 1 {
+		t.Fatalf("%d clients left", n)
+	}
+
+	server.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-clients[1].Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("client not disconnected on Close")
+	}
+}
+
+func TestServerBroadcastStuckClient(t *testing.T) {
+	listener, err := Listen(filepath.Join(t.TempDir(), "control.sock"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(listener)
+	server.BroadcastTimeout = 100 * time.Millisecond
+	connected := make(chan *Channel, 2)
+	server.OnConnect(func(channel *Channel) {
+		connected <- channel
+	})
+	go server.Serve()
+	defer server.Close()
+
+	// one client doesn't dispatch, its socket fills up
+	stuck, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	stuckEnd := <-connected
+
+	received := make(chan struct{}, 1024)
+	client, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Handler(testMsgRaw, func(msg *IPCMessage) {
+		received <- struct{}{}
+	})
+	client.Dispatch()
+	<-connected
+
+	payload := make([]byte, 32*1024)
+	sent := 0
+	for stuckEnd.Err() == nil {
+		if sent == cap(received) {
+			t.Fatal("stuck client never failed")
+		}
+		start := time.Now()
+		err := server.Broadcast(testMsgRaw, payload, nil)
+		if time.Since(start) > time.Second {
+			t.Fatalf("broadcast held up for %v", time.Since(start))
+		}
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatal(err)
+		}
+		sent++
+	}
+
+	// everyone else got every message
+	for i := 0; i < sent; i++ {
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%d broadcasts out of %d received", i, sent)
+		}
+	}
+	if client.Err() != nil {
+		t.Fatal(client.Err())
+	}
+}
+
+func TestServerCloseStuckClient(t *testing.T) {
+	listener, err := Listen(filepath.Join(t.TempDir(), "control.sock"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(listener)
+	server.BroadcastTimeout = 100 * time.Millisecond
+	connected := make(chan *Channel, 1)
+	server.OnConnect(func(channel *Channel) {
+		connected <- channel
+	})
+	go server.Serve()
+
+	// the client doesn't dispatch, the writer ends up stuck
+	stuck, err := Dial(listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stuck.Close()
+	stuckEnd := <-connected
+	payload := make([]byte, 1024*1024)
+	for i := 0; i < 10; i++ {
+		go stuckEnd.Message(testMsgRaw, payload, -1)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		server.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close held up by a stuck client")
+	}
+}
+func TestSpawn(t *testing.T) {
+	channel, cmd, err := Spawn("echo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := channel.RequirePeer(cmd.Process.Pid, os.Geteuid()); err != nil {
+		t.Fatal(err)
+	}
+	channel.Dispatch()
+
+	reply, err := channel.Query(testMsgPing, "echo", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cred, err := reply.Sender(); err != nil || cred.Pid != cmd.Process.Pid {
+		t.Fatalf("unexpected sender %+v: %v", cred, err)
+	}
+	var data string
+	reply.Unmarshal(&data)
+	if data != "echo" {
+		t.Fatalf("unexpected reply %q", data)
+	}
+
+	channel.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSpawnExitStatus(t *testing.T) {
+	channel, cmd, err := Spawn("crash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel.Dispatch()
+
+	select {
+	case <-channel.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("child exit not noticed")
+	}
+	var exitErr *ExitError
+	if err := channel.Err(); !errors.As(err, &exitErr) || !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("channel failed with %v", err)
+	}
+	if exitErr.Pid != cmd.Process.Pid || exitErr.State.ExitCode() != 3 {
+		t.Fatalf("unexpected exit %v", exitErr)
+	}
+	if err := cmd.Wait(); err == nil {
+		t.Fatal("Wait returned no error")
+	}
+}
+
+func TestSupervisor(t *testing.T) {
+	supervisor := NewSupervisor()
+	exits := make(chan string, 16)
+	supervisor.OnExit(func(role string, state *os.ProcessState) {
+		exits <- role
+	})
+
+	supervisor.AddRole(RoleConfig{Name: "echo"})
+	supervisor.AddRole(RoleConfig{
+		Name:       "crash",
+		MinBackoff: 10 * time.Millisecond,
+	})
+	supervisor.Start()
+
+	// the crashing role keeps being restarted
+	for i := 0; i < 3; i++ {
+		select {
+		case role := <-exits:
+			if role != "crash" {
+				t.Fatalf("role %s exited", role)
+			}
+		case <-time.After(10 * time.Second):
+			t.Fatal("crashing role not restarted")
+		}
+	}
+
+	channel := supervisor.Channel("echo")
+	if channel == nil {
+		t.Fatal("no channel to echo")
+	}
+	if _, err := channel.Query(testMsgPing, "echo", -1); err != nil {
+		t.Fatal(err)
+	}
+
+	supervisor.Shutdown()
+	if supervisor.Channel("echo") != nil {
+		t.Fatal("channel to echo survived shutdown")
+	}
+}
+
+func TestSupervisorShutdownPolicy(t *testing.T) {
+	supervisor := NewSupervisor()
+	supervisor.AddRole(RoleConfig{Name: "echo"})
+	supervisor.AddRole(RoleConfig{Name: "crash", Policy: IPCMSG_SHUTDOWN})
+	supervisor.Start()
+
+	select {
+	case <-supervisor.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("tree not shut down")
+	}
+	if !errors.Is(supervisor.Err(), ErrRoleExited) {
+		t.Fatalf("unexpected error: %v", supervisor.Err())
+	}
+}
+
+func TestSupervisorShutdownStuckChild(t *testing.T) {
+	supervisor := NewSupervisor()
+	supervisor.ShutdownTimeout = 100 * time.Millisecond
+	supervisor.AddRole(RoleConfig{Name: "hang"})
+	supervisor.Start()
+
+	var channel *Channel
+	for channel == nil {
+		time.Sleep(10 * time.Millisecond)
+		channel = supervisor.Channel("hang")
+	}
+
+	// the child doesn't read, its socket fills up
+	payload := make([]byte, 1024*1024)
+	for i := 0; i < 10; i++ {
+		go channel.Message(testMsgRaw, payload, -1)
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	shutdown := make(chan struct{})
+	go func() {
+		supervisor.Shutdown()
+		close(shutdown)
+	}()
+	select {
+	case <-shutdown:
+	case <-time.After(3 * time.Second):
+		t.Fatal("shutdown held up by a stuck child")
+	}
+}
+
+func TestSupervisorChannelFailure(t *testing.T) {
+	supervisor := NewSupervisor()
+	exits := make(chan *os.ProcessState, 1)
+	supervisor.OnExit(func(role string, state *os.ProcessState) {
+		exits <- state
+	})
+
+	// the process doesn't notice its channel went down
+	supervisor.AddRole(RoleConfig{
+		Name:   "hang",
+		Policy: IPCMSG_SHUTDOWN,
+		Setup: func(channel *Channel) {
+			channel.RequirePeer(-1, os.Geteuid()+1)
+		},
+	})
+	supervisor.Start()
+
+	select {
+	case <-supervisor.Done():
+	case <-time.After(10 * time.Second):
+		t.Fatal("tree not shut down")
+	}
+	if err := supervisor.Err(); !errors.Is(err, ErrRoleExited) || !strings.Contains(err.Error(), ErrPeerMismatch.Error()) {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if state := <-exits; state.Success() {
+		t.Fatalf("process not killed: %v", state)
+	}
 }
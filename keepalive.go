@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+var ErrPeerUnresponsive = errors.New("ipcmsg: peer unresponsive")
+
+// SetKeepalive pings the peer every interval and fails the channel with
+// ErrPeerUnresponsive once maxMissed pings in a row went unanswered. the peer
+// answers from its Dispatch() loop, so one stuck in a handler is caught too.
+// a zero interval stops the keepalive.
+func (channel *Channel) SetKeepalive(interval time.Duration, maxMissed int) {
+	channel.muKeepalive.Lock()
+	defer channel.muKeepalive.Unlock()
+
+	if channel.keepaliveStop != nil {
+		close(channel.keepaliveStop)
+		channel.keepaliveStop = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	if maxMissed < 1 {
+		maxMissed = 1
+	}
+	if channel.pingEpoch.IsZero() {
+		channel.pingEpoch = time.Now()
+	}
+	channel.pingPending = false
+	channel.pingsMissed = 0
+
+	stop := make(chan struct{})
+	channel.keepaliveStop = stop
+	go channel.keepalive(interval, maxMissed, stop)
+}
+
+// RTT returns the round-trip time measured by the last answered ping,
+// zero if none was.
+func (channel *Channel) RTT() time.Duration {
+	channel.muKeepalive.Lock()
+	defer channel.muKeepalive.Unlock()
+	return channel.rtt
+}
+
+func (channel *Channel) keepalive(interval time.Duration, maxMissed int, stop chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		case <-channel.failed:
+			return
+		}
+
+		channel.muKeepalive.Lock()
+		if channel.pingPending {
+			channel.pingsMissed++
+		}
+		missed := channel.pingsMissed
+		sent := time.Since(channel.pingEpoch)
+		channel.pingPending = true
+		channel.muKeepalive.Unlock()
+
+		if missed >= maxMissed {
+			channel.fail(channel.errorf("%d pings unanswered: %w", missed, ErrPeerUnresponsive))
+			return
+		}
+
+		// the ping carries its send time, any pong proves the peer alive
+		// even if it answers slower than interval
+		payload := make([]byte, 8)
+		binary.BigEndian.PutUint64(payload, uint64(sent))
+		msg, err := createMessage(RawCodec{}, IPCMSG_PING, payload, nil)
+		if err != nil {
+			continue
+		}
+		msg.hdr.Kind = IPCMSG_KIND_REQUEST
+
+		// a peer that doesn't read fills the socket, this counts as a miss
+		ctx, cancel := context.WithTimeout(context.Background(), interval)
+		channel.write(ctx, msg)
+		cancel()
+	}
+}
+
+// pong records the answer to one of our pings.
+func (channel *Channel) pong(msg *IPCMessage) error {
+	if len(msg.data) != 8 || len(msg.fds) != 0 {
+		closeFds(msg.fds)
+		return channel.errorf("pong: %w", ErrMalformedMessage)
+	}
+	sent := time.Duration(binary.BigEndian.Uint64(msg.data))
+
+	channel.muKeepalive.Lock()
+	defer channel.muKeepalive.Unlock()
+
+	if channel.pingEpoch.IsZero() {
+		return nil
+	}
+	rtt := time.Since(channel.pingEpoch) - sent
+	if rtt < 0 {
+		return nil
+	}
+	channel.rtt = rtt
+	channel.pingPending = false
+	channel.pingsMissed = 0
+	return nil
+}
+
+// ping answers a ping from the peer, echoing its payload.
+func (channel *Channel) ping(msg *IPCMessage) {
+	closeFds(msg.fds)
+	msg.Reply(IPCMSG_PONG, msg.data, -1)
+}
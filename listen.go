@@ -0,0 +1,247 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var ErrAddressInUse = errors.New("ipcmsg: address already in use")
+
+// ListenOptions tweaks the socket created by Listen(), the zero value keeps
+// the umask defaults for a SOCK_STREAM socket.
+type ListenOptions struct {
+	// permissions of the socket file, which is what restricts who may connect
+	Mode os.FileMode
+
+	// change the owner of the socket file to Uid and Gid, -1 keeping either
+	Chown bool
+	Uid   int
+	Gid   int
+
+	// SOCK_STREAM if left to zero, or SOCK_SEQPACKET
+	SocketType int
+}
+
+// Listener accepts connections on a Unix socket and yields a channel for each.
+type Listener struct {
+	path     string
+	listener *net.UnixListener
+}
+
+// Listen creates a Unix socket at path and listens on it. a stale socket left
+// behind by a dead process is removed, one still in use is not. a path starting
+// with @ is in the abstract namespace: no file is created, opts Mode and Chown
+// don't apply and it is only supported on Linux.
+func Listen(path string, opts *ListenOptions) (*Listener, error) {
+	if opts == nil {
+		opts = &ListenOptions{}
+	}
+	sotype := opts.SocketType
+	if sotype == 0 {
+		sotype = syscall.SOCK_STREAM
+	}
+	if sotype != syscall.SOCK_STREAM && sotype != syscall.SOCK_SEQPACKET {
+		return nil, fmt.Errorf("listen %s: unsupported socket type %d", path, sotype)
+	}
+
+	abstract := strings.HasPrefix(path, "@")
+	if abstract && runtime.GOOS != "linux" {
+		return nil, fmt.Errorf("listen %s: abstract namespace: %w", path, ErrNotSupported)
+	}
+	if !abstract {
+		if err := removeStale(path); err != nil {
+			return nil, fmt.Errorf("listen %s: %w", path, err)
+		}
+	}
+
+	syscall.ForkLock.RLock()
+	fd, err := syscall.Socket(syscall.AF_UNIX, sotype, 0)
+	if err == nil {
+		syscall.CloseOnExec(fd)
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+	file := os.NewFile(uintptr(fd), path)
+	defer file.Close()
+
+	// permissions are set before listen(), so nobody gets to connect in between
+	if err := syscall.Bind(fd, &syscall.SockaddrUnix{Name: path}); err != nil {
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+	if err := setupSocketFile(path, abstract, opts); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+	if err := syscall.Listen(fd, syscall.SOMAXCONN); err != nil {
+		if !abstract {
+			os.Remove(path)
+		}
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		if !abstract {
+			os.Remove(path)
+		}
+		return nil, fmt.Errorf("listen %s: %w", path, err)
+	}
+	return &Listener{path: path, listener: listener.(*net.UnixListener)}, nil
+}
+
+func setupSocketFile(path string, abstract bool, opts *ListenOptions) error {
+	if abstract {
+		return nil
+	}
+	if opts.Mode != 0 {
+		if err := os.Chmod(path, opts.Mode); err != nil {
+			return err
+		}
+	}
+	if opts.Chown {
+		if err := os.Lchown(path, opts.Uid, opts.Gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeStale removes a socket nobody listens on anymore at path, anything
+// that isn't a socket is left alone.
+func removeStale(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("not a socket: %w", ErrAddressInUse)
+	}
+
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return ErrAddressInUse
+	}
+	if errors.Is(err, syscall.EPROTOTYPE) {
+		// someone listens with another socket type
+		return ErrAddressInUse
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Accept waits for a client and returns a channel to it, ErrClosed once the
+// listener was closed.
+func (listener *Listener) Accept() (*Channel, error) {
+	conn, err := listener.listener.AcceptUnix()
+	if err != nil {
+		if errors.Is(err, net.ErrClosed) {
+			return nil, ErrClosed
+		}
+		return nil, fmt.Errorf("accept %s: %w", listener.path, err)
+	}
+
+	peer := "client"
+	pid := 0
+	if cred, err := getPeerCred(conn); err == nil {
+		peer = fmt.Sprintf("%d", cred.Pid)
+		pid = cred.Pid
+	}
+	return connChannel(listener.path+"<->"+peer, pid, conn)
+}
+
+// Addr returns the address the listener is bound to.
+func (listener *Listener) Addr() net.Addr {
+	return listener.listener.Addr()
+}
+
+// Close stops listening and removes the socket file, channels already
+// accepted are not affected.
+func (listener *Listener) Close() error {
+	err := listener.listener.Close()
+	if !strings.HasPrefix(listener.path, "@") {
+		os.Remove(listener.path)
+	}
+	return err
+}
+
+// Dial connects to a daemon listening at path and returns a channel to it,
+// the socket type is picked to match the listener.
+func Dial(path string) (*Channel, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if errors.Is(err, syscall.EPROTOTYPE) {
+		conn, err = net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: path, Net: "unixpacket"})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pid := 0
+	if cred, err := getPeerCred(conn); err == nil {
+		pid = cred.Pid
+	}
+	return connChannel("client<->"+path, pid, conn)
+}
+
+// connChannel turns conn into a channel, conn is closed in any case.
+func connChannel(name string, peerid int, conn *net.UnixConn) (*Channel, error) {
+	defer conn.Close()
+
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return nil, fmt.Errorf("channel %s: %w", name, err)
+	}
+
+	fd := -1
+	var dupErr error
+	syscall.ForkLock.RLock()
+	err = rawConn.Control(func(s uintptr) {
+		fd, dupErr = syscall.Dup(int(s))
+		if dupErr == nil {
+			syscall.CloseOnExec(fd)
+		}
+	})
+	syscall.ForkLock.RUnlock()
+	if err == nil {
+		err = dupErr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("channel %s: %w", name, err)
+	}
+
+	channel, err := TryNewChannel(name, peerid, fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return channel, nil
+}
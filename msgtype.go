@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"encoding/gob"
+	"fmt"
+	"hash/fnv"
+	"reflect"
+	"sync"
+)
+
+type IPCMsgType uint32
+
+// reserved message types, the ping and pong control messages bypass handlers
+// and policies
+const (
+	IPCMSG_PING  IPCMsgType = 0xfffffff0
+	IPCMSG_PONG  IPCMsgType = 0xfffffff1
+	IPCMSG_ERROR IPCMsgType = 0xfffffff2
+)
+
+// IPCMsgKind tells what a message is for, regardless of its type.
+type IPCMsgKind uint8
+
+const (
+	// one-way message, as sent by Message()
+	IPCMSG_KIND_NOTIFY IPCMsgKind = iota
+	// sent by Query(), the handler is expected to reply
+	IPCMSG_KIND_REQUEST
+	// sent by Reply(), it only ever goes to the query waiting for it
+	IPCMSG_KIND_REPLY
+	// sent by ReplyError(), the query fails with a RemoteError
+	IPCMSG_KIND_ERROR
+)
+
+func (kind IPCMsgKind) String() string {
+	switch kind {
+	case IPCMSG_KIND_NOTIFY:
+		return "notify"
+	case IPCMSG_KIND_REQUEST:
+		return "request"
+	case IPCMSG_KIND_REPLY:
+		return "reply"
+	case IPCMSG_KIND_ERROR:
+		return "error"
+	}
+	return fmt.Sprintf("IPCMsgKind(%d)", uint8(kind))
+}
+
+type msgTypeInfo struct {
+	name   string
+	goType reflect.Type
+}
+
+var (
+	muMsgTypes sync.RWMutex
+	msgTypes   = make(map[IPCMsgType]msgTypeInfo)
+	nextType   IPCMsgType
+)
+
+func init() {
+	registerMsgType(IPCMSG_PING, "IPCMSG_PING", []byte{})
+	registerMsgType(IPCMSG_PONG, "IPCMSG_PONG", []byte{})
+	registerMsgType(IPCMSG_ERROR, "IPCMSG_ERROR", RemoteError{})
+	SetTypeCodec(IPCMSG_PING, RawCodec{})
+	SetTypeCodec(IPCMSG_PONG, RawCodec{})
+	SetTypeCodec(IPCMSG_ERROR, JSONCodec{})
+}
+
+// NewIPCMsgType registers a message type under the next free ID, which depends
+// on registration order: both ends must be built from the same code. prefer
+// NewIPCMsgTypeID or NewIPCMsgTypeName when they may not be.
+func NewIPCMsgType(msgObject interface{}) IPCMsgType {
+	muMsgTypes.Lock()
+	for {
+		if _, exists := msgTypes[nextType]; !exists {
+			break
+		}
+		nextType++
+	}
+	msgType := nextType
+	muMsgTypes.Unlock()
+
+	return registerMsgType(msgType, "", msgObject)
+}
+
+// NewIPCMsgTypeID registers a message type under an explicit ID,
+// it panics if the ID is already taken.
+func NewIPCMsgTypeID(id uint32, name string, msgObject interface{}) IPCMsgType {
+	return registerMsgType(IPCMsgType(id), name, msgObject)
+}
+
+// NewIPCMsgTypeName registers a message type under an ID derived from a hash
+// of its name, it panics if the ID is already taken.
+func NewIPCMsgTypeName(name string, msgObject interface{}) IPCMsgType {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return registerMsgType(IPCMsgType(hash.Sum32()), name, msgObject)
+}
+
+func registerMsgType(msgType IPCMsgType, name string, msgObject interface{}) IPCMsgType {
+	muMsgTypes.Lock()
+	defer muMsgTypes.Unlock()
+
+	if info, exists := msgTypes[msgType]; exists {
+		panic(fmt.Sprintf("IPC message type %d (%s) already registered as %s", msgType, name, info.name))
+	}
+	msgTypes[msgType] = msgTypeInfo{name: name, goType: reflect.TypeOf(msgObject)}
+	gob.Register(msgObject)
+	return msgType
+}
+
+// LookupIPCMsgType returns the name and Go type of the payload of a registered
+// message type.
+func LookupIPCMsgType(msgtype IPCMsgType) (string, reflect.Type, bool) {
+	muMsgTypes.RLock()
+	defer muMsgTypes.RUnlock()
+	info, exists := msgTypes[msgtype]
+	return info.name, info.goType, exists
+}
+
+func (msgtype IPCMsgType) String() string {
+	if name, _, exists := LookupIPCMsgType(msgtype); exists && name != "" {
+		return name
+	}
+	return fmt.Sprintf("IPCMsgType(%d)", uint32(msgtype))
+}
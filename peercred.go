@@ -0,0 +1,69 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNotSupported = errors.New("ipcmsg: not supported on this system")
+	ErrPeerMismatch = errors.New("ipcmsg: unexpected peer credentials")
+)
+
+// PeerCred holds the credentials of the process at the other end of a channel,
+// as reported by the kernel when the channel was set up.
+type PeerCred struct {
+	Pid int
+	Uid int
+	Gid int
+}
+
+// PeerCred returns the credentials of the peer, they can't be forged by the
+// peer unlike the pid it may claim in message headers. they are captured when
+// the socket is connected: for a socketpair, that's the credentials of the
+// process which created it, not of the child it was handed to, except for
+// channels returned by Cmd.Start() which carry those the child was started
+// with.
+func (channel *Channel) PeerCred() (PeerCred, error) {
+	return channel.peerCred, channel.peerCredErr
+}
+
+// RequirePeer checks the peer credentials against the expected pid and uid,
+// -1 meaning any. on mismatch, or if the credentials are not available, the
+// channel is moved into a failed state and the error is returned: it should
+// be called before Dispatch() so no message from an unexpected peer is handled.
+func (channel *Channel) RequirePeer(pid int, uid int) error {
+	cred, err := channel.PeerCred()
+	if err == nil {
+		if (pid != -1 && cred.Pid != pid) || (uid != -1 && cred.Uid != uid) {
+			err = fmt.Errorf("pid %d uid %d: %w", cred.Pid, cred.Uid, ErrPeerMismatch)
+		}
+	}
+	if err != nil {
+		err = channel.errorf("%w", err)
+		channel.fail(err)
+		return err
+	}
+	return nil
+}
+
+// Sender returns the credentials of the process that sent the message.
+func (msg *IPCMessage) Sender() (PeerCred, error) {
+	return msg.channel.PeerCred()
+}
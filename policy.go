@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var ErrPolicyViolation = errors.New("ipcmsg: policy violation")
+
+// Policy restricts what the peer may send on a channel, it is meant for
+// channels to less trusted processes, such as the unprivileged side of a
+// privilege separated program.
+type Policy struct {
+	// message types the peer may send, mapped to whether they may carry FDs
+	Allow map[IPCMsgType]bool
+
+	// tear the channel down on the first violation, as the peer is
+	// most-likely compromised
+	Teardown bool
+}
+
+// SetPolicy enforces policy on received messages. messages violating it are
+// dropped before they reach Dispatch() or ChannelIn(), replies included,
+// and counted. error replies to queries sent on the channel are always let
+// through. a nil policy lets everything through.
+func (channel *Channel) SetPolicy(policy *Policy) {
+	var p *Policy
+	if policy != nil {
+		p = &Policy{Allow: make(map[IPCMsgType]bool), Teardown: policy.Teardown}
+		for msgtype, withFds := range policy.Allow {
+			p.Allow[msgtype] = withFds
+		}
+	}
+
+	channel.muPolicy.Lock()
+	defer channel.muPolicy.Unlock()
+	channel.policy = p
+}
+
+// OnViolation registers a hook called for every message dropped by the policy.
+func (channel *Channel) OnViolation(hook func(error)) {
+	channel.muPolicy.Lock()
+	defer channel.muPolicy.Unlock()
+	channel.onViolation = hook
+}
+
+// Violations returns how many received messages violated the policy.
+func (channel *Channel) Violations() uint64 {
+	return atomic.LoadUint64(&channel.violations)
+}
+
+// checkPolicy reports whether msg is allowed by the channel policy, the FDs
+// of a rejected message are closed. an error is returned if the violation
+// requires the channel to be torn down.
+func (channel *Channel) checkPolicy(msg *IPCMessage) (bool, error) {
+	channel.muPolicy.Lock()
+	policy := channel.policy
+	onViolation := channel.onViolation
+	channel.muPolicy.Unlock()
+
+	if policy == nil {
+		return true, nil
+	}
+
+	withFds, allowed := policy.Allow[msg.hdr.Type]
+	if allowed && (withFds || msg.hdr.NumFds == 0) {
+		return true, nil
+	}
+
+	closeFds(msg.fds)
+	atomic.AddUint64(&channel.violations, 1)
+
+	var err error
+	if !allowed {
+		err = channel.errorf("message type %v: %w", msg.hdr.Type, ErrPolicyViolation)
+	} else {
+		err = channel.errorf("message type %v with %d fds: %w", msg.hdr.Type, msg.hdr.NumFds, ErrPolicyViolation)
+	}
+	if onViolation != nil {
+		onViolation(err)
+	}
+	if policy.Teardown {
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,230 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// default for Server.BroadcastTimeout
+const IPCMSG_BROADCAST_TIMEOUT = 5 * time.Second
+
+// Server accepts clients on a listener and serves them all from a shared
+// handler table, as a daemon does with its control clients.
+type Server struct {
+	// clients beyond that many are disconnected as soon as they are accepted,
+	// zero means no limit
+	MaxClients int
+
+	// how long Broadcast() waits for a client to take a message, and Close()
+	// for a client to take those it was sent, a client that doesn't is
+	// disconnected. zero means no limit for Broadcast() and
+	// IPCMSG_CLOSE_TIMEOUT for Close()
+	BroadcastTimeout time.Duration
+
+	listener *Listener
+
+	mu           sync.Mutex
+	handlers     map[IPCMsgType]func(*IPCMessage)
+	clients      map[*Channel]struct{}
+	closed       bool
+	onConnect    func(*Channel)
+	onDisconnect func(*Channel, error)
+}
+
+func NewServer(listener *Listener) *Server {
+	return &Server{
+		BroadcastTimeout: IPCMSG_BROADCAST_TIMEOUT,
+		listener:         listener,
+		handlers:         make(map[IPCMsgType]func(*IPCMessage)),
+		clients:          make(map[*Channel]struct{}),
+	}
+}
+
+// Handler registers a handler for msgtype shared by all clients, a handler
+// registered on a client channel takes precedence over it.
+// IPCMessage.Channel() tells which client a message comes from.
+func (server *Server) Handler(msgtype IPCMsgType, handler func(*IPCMessage)) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.handlers[msgtype] = handler
+}
+
+// QueryHandler is like Channel.QueryHandler for a handler shared by all clients.
+func (server *Server) QueryHandler(msgtype IPCMsgType, replytype IPCMsgType, handler func(*IPCMessage) (interface{}, int, error)) {
+	server.Handler(msgtype, queryHandler(replytype, handler))
+}
+
+func (server *Server) handler(msgtype IPCMsgType) (func(*IPCMessage), bool) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	handler, exists := server.handlers[msgtype]
+	return handler, exists
+}
+
+// OnConnect registers a hook called with every accepted client before
+// dispatching starts, to set its state with Channel.SetState(), check its
+// credentials or restrict it with a policy.
+func (server *Server) OnConnect(hook func(*Channel)) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.onConnect = hook
+}
+
+// OnDisconnect registers a hook called with every client that went away
+// and the reason.
+func (server *Server) OnDisconnect(hook func(*Channel, error)) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.onDisconnect = hook
+}
+
+// Serve accepts clients until the server is closed, it then returns nil.
+func (server *Server) Serve() error {
+	for {
+		channel, err := server.listener.Accept()
+		if errors.Is(err, ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		server.mu.Lock()
+		if server.closed || (server.MaxClients > 0 && len(server.clients) >= server.MaxClients) {
+			server.mu.Unlock()
+			channel.Close()
+			continue
+		}
+		server.clients[channel] = struct{}{}
+		onConnect := server.onConnect
+		server.mu.Unlock()
+
+		channel.server = server
+		if onConnect != nil {
+			onConnect(channel)
+		}
+		channel.Dispatch()
+
+		go func() {
+			<-channel.Done()
+
+			server.mu.Lock()
+			delete(server.clients, channel)
+			onDisconnect := server.onDisconnect
+			server.mu.Unlock()
+
+			if onDisconnect != nil {
+				onDisconnect(channel, channel.Err())
+			}
+		}()
+	}
+}
+
+// Clients returns the channels to the connected clients.
+func (server *Server) Clients() []*Channel {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	clients := make([]*Channel, 0, len(server.clients))
+	for channel := range server.clients {
+		clients = append(clients, channel)
+	}
+	return clients
+}
+
+// Broadcast sends a message to every client filter returns true for, or to all
+// of them if filter is nil. clients are sent to concurrently, one that doesn't
+// take the message within BroadcastTimeout is disconnected so it holds nobody
+// up. clients that went away meanwhile are skipped, the first other error is
+// returned once everyone else got the message.
+func (server *Server) Broadcast(msgtype IPCMsgType, data interface{}, filter func(*Channel) bool) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	for _, channel := range server.Clients() {
+		if filter != nil && !filter(channel) {
+			continue
+		}
+		wg.Add(1)
+		go func(channel *Channel) {
+			defer wg.Done()
+			err := server.broadcast(channel, msgtype, data)
+			mu.Lock()
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			mu.Unlock()
+		}(channel)
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (server *Server) broadcast(channel *Channel, msgtype IPCMsgType, data interface{}) error {
+	msg, err := createMessage(channel.codecFor(msgtype), msgtype, data, nil)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if server.BroadcastTimeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, server.BroadcastTimeout)
+		defer cancel()
+	}
+
+	err = channel.write(ctx, msg)
+	if errors.Is(err, context.DeadlineExceeded) {
+		// the writer is stuck on a client that doesn't read,
+		// failing the channel unblocks it
+		err = channel.errorf("broadcast: %w", err)
+		channel.fail(err)
+		return err
+	}
+	if err != nil && channel.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// Close stops accepting clients and disconnects those connected, a client
+// that doesn't take the messages it was sent holds nobody up.
+func (server *Server) Close() error {
+	server.mu.Lock()
+	server.closed = true
+	server.mu.Unlock()
+
+	timeout := server.BroadcastTimeout
+	if timeout == 0 {
+		timeout = IPCMSG_CLOSE_TIMEOUT
+	}
+
+	err := server.listener.Close()
+	var wg sync.WaitGroup
+	for _, channel := range server.Clients() {
+		wg.Add(1)
+		go func(channel *Channel) {
+			defer wg.Done()
+			channel.closeWithin(timeout)
+		}(channel)
+	}
+	wg.Wait()
+	return err
+}
@@ -0,0 +1,205 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// environment through which a spawned child learns its role and channel fd
+const (
+	IPCMSG_ENV_ROLE = "IPCMSG_ROLE"
+	IPCMSG_ENV_FD   = "IPCMSG_FD"
+)
+
+var ErrNotChild = errors.New("ipcmsg: not a spawned child")
+
+// kept aside as ChildChannel() clears the environment
+var role = os.Getenv(IPCMSG_ENV_ROLE)
+
+// Cmd re-executes the current binary in a named role, connected to the parent
+// by a socketpair. the embedded exec.Cmd may be tweaked before Start().
+type Cmd struct {
+	*exec.Cmd
+
+	Role string
+
+	// SOCK_STREAM if left to zero
+	SocketType int
+
+	// the child is reaped as soon as it exits so the channel can report why
+	// it went away, Wait() hands the outcome over
+	exited  chan struct{}
+	waitErr error
+}
+
+// how long a channel to a spawned child waits for it to exit after it closed
+// its end, so the exit status can be reported as the reason
+const IPCMSG_EXIT_GRACE = 500 * time.Millisecond
+
+// ExitError is the reason a channel to a spawned child went down when the
+// child exited, it wraps ErrPeerClosed.
+type ExitError struct {
+	Pid   int
+	State *os.ProcessState
+}
+
+func (err *ExitError) Error() string {
+	return fmt.Sprintf("process %d: %s", err.Pid, err.State)
+}
+
+func (err *ExitError) Unwrap() error {
+	return ErrPeerClosed
+}
+
+// Command prepares the re-execution of the current binary in role,
+// args are passed to the child after its program name.
+func Command(role string, args ...string) (*Cmd, error) {
+	binary, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(binary, args...)
+	cmd.Args[0] = os.Args[0]
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	return &Cmd{Cmd: cmd, Role: role}, nil
+}
+
+// Start sets up the socketpair, starts the child with one end of it and
+// returns a channel on the other end.
+func (cmd *Cmd) Start() (*Channel, error) {
+	sotype := cmd.SocketType
+	if sotype == 0 {
+		sotype = syscall.SOCK_STREAM
+	}
+
+	// both ends are close-on-exec so they don't leak into other children,
+	// exec.Cmd dups the child end into place without the flag
+	syscall.ForkLock.RLock()
+	sp, err := syscall.Socketpair(syscall.AF_LOCAL, sotype, syscall.AF_UNSPEC)
+	if err == nil {
+		syscall.CloseOnExec(sp[0])
+		syscall.CloseOnExec(sp[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	childEnd := os.NewFile(uintptr(sp[0]), "ipcmsg-"+cmd.Role)
+	defer childEnd.Close()
+
+	// ExtraFiles start at fd 3 in the child
+	childFd := 3 + len(cmd.ExtraFiles)
+	cmd.ExtraFiles = append(cmd.ExtraFiles, childEnd)
+	if cmd.Env == nil {
+		cmd.Env = os.Environ()
+	}
+	cmd.Env = append(cmd.Env,
+		IPCMSG_ENV_ROLE+"="+cmd.Role,
+		IPCMSG_ENV_FD+"="+strconv.Itoa(childFd))
+
+	if err := cmd.Cmd.Start(); err != nil {
+		syscall.Close(sp[1])
+		return nil, err
+	}
+
+	cmd.exited = make(chan struct{})
+	go func() {
+		cmd.waitErr = cmd.Cmd.Wait()
+		close(cmd.exited)
+	}()
+
+	channel, err := newChannel("parent<->"+cmd.Role, cmd.Process.Pid, sp[1], cmd)
+	if err != nil {
+		syscall.Close(sp[1])
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+
+	// the kernel reports ourselves as the peer of a socketpair we created,
+	// but we know which process holds the other end and as whom it runs
+	cred := PeerCred{Pid: cmd.Process.Pid, Uid: os.Geteuid(), Gid: os.Getegid()}
+	if attr := cmd.SysProcAttr; attr != nil && attr.Credential != nil {
+		cred.Uid = int(attr.Credential.Uid)
+		cred.Gid = int(attr.Credential.Gid)
+	}
+	channel.peerCred, channel.peerCredErr = cred, nil
+	return channel, nil
+}
+
+// Wait waits for the child to exit, like exec.Cmd.Wait() but it may be
+// called by several goroutines once Start() succeeded.
+func (cmd *Cmd) Wait() error {
+	if cmd.exited == nil {
+		return cmd.Cmd.Wait()
+	}
+	<-cmd.exited
+	return cmd.waitErr
+}
+
+// Spawn re-executes the current binary in role and returns a channel to it.
+func Spawn(role string, args ...string) (*Channel, *Cmd, error) {
+	cmd, err := Command(role, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	channel, err := cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+	return channel, cmd, nil
+}
+
+// Role returns the role the current process was spawned in,
+// or an empty string if it was not spawned by Spawn or Command.
+func Role() string {
+	return role
+}
+
+// ChildChannel returns the channel to the parent in a spawned child, the
+// environment variables describing it are cleared so they don't propagate
+// to processes the child executes.
+func ChildChannel() (*Channel, error) {
+	value, exists := os.LookupEnv(IPCMSG_ENV_FD)
+	if role == "" || !exists {
+		return nil, ErrNotChild
+	}
+	fd, err := strconv.Atoi(value)
+	if err != nil || fd < 0 {
+		return nil, fmt.Errorf("%s=%q: %w", IPCMSG_ENV_FD, value, ErrNotChild)
+	}
+
+	channel, err := TryNewChannel(role+"<->parent", os.Getppid(), fd)
+	if err != nil {
+		return nil, err
+	}
+	os.Unsetenv(IPCMSG_ENV_ROLE)
+	os.Unsetenv(IPCMSG_ENV_FD)
+	return channel, nil
+}
@@ -0,0 +1,333 @@
+/*
+ * Copyright (c) 2021 Gilles Chehade <gilles@poolp.org>
+ *
+ * Permission to use, copy, modify, and distribute this software for any
+ * purpose with or without fee is hereby granted, provided that the above
+ * copyright notice and this permission notice appear in all copies.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS" AND THE AUTHOR DISCLAIMS ALL WARRANTIES
+ * WITH REGARD TO THIS SOFTWARE INCLUDING ALL IMPLIED WARRANTIES OF
+ * MERCHANTABILITY AND FITNESS. IN NO EVENT SHALL THE AUTHOR BE LIABLE FOR
+ * ANY SPECIAL, DIRECT, INDIRECT, OR CONSEQUENTIAL DAMAGES OR ANY DAMAGES
+ * WHATSOEVER RESULTING FROM LOSS OF USE, DATA OR PROFITS, WHETHER IN AN
+ * ACTION OF CONTRACT, NEGLIGENCE OR OTHER TORTIOUS ACTION, ARISING OUT OF
+ * OR IN CONNECTION WITH THE USE OR PERFORMANCE OF THIS SOFTWARE.
+ */
+
+package ipcmsg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrRoleExited = errors.New("ipcmsg: role exited")
+
+// RestartPolicy tells a Supervisor what to do when a process exits.
+type RestartPolicy int
+
+const (
+	// restart the process that exited, backing off if it keeps exiting
+	IPCMSG_RESTART_ROLE RestartPolicy = iota
+	// restart every process of the tree
+	IPCMSG_RESTART_ALL
+	// shut the whole tree down
+	IPCMSG_SHUTDOWN
+)
+
+// defaults for RoleConfig and Supervisor
+const (
+	IPCMSG_MIN_BACKOFF      = 100 * time.Millisecond
+	IPCMSG_MAX_BACKOFF      = 30 * time.Second
+	IPCMSG_SHUTDOWN_TIMEOUT = 5 * time.Second
+)
+
+// RoleConfig declares a role of a Supervisor.
+type RoleConfig struct {
+	Name string
+	Args []string
+
+	Policy RestartPolicy
+
+	// delay before restarting a process that exited, doubled every time it
+	// exits again within MaxBackoff
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Setup is called with the channel to every new process of the role,
+	// before dispatching starts, to register handlers
+	Setup func(*Channel)
+}
+
+type supervisedRole struct {
+	config  RoleConfig
+	cmd     *Cmd
+	channel *Channel
+
+	// the supervisor killed the process itself, its exit is not subject to policy
+	killed bool
+}
+
+// Supervisor spawns the processes of a privilege separated program, one per
+// role, owns the channels to them and applies the role policy when they exit.
+type Supervisor struct {
+	// how long processes are given to exit once their channel is closed
+	// on shutdown, before they are killed
+	ShutdownTimeout time.Duration
+
+	mu       sync.Mutex
+	roles    map[string]*supervisedRole
+	started  bool
+	stopping bool
+	err      error
+	onExit   func(string, *os.ProcessState)
+
+	wg   sync.WaitGroup
+	stop chan struct{}
+	done chan struct{}
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		ShutdownTimeout: IPCMSG_SHUTDOWN_TIMEOUT,
+		roles:           make(map[string]*supervisedRole),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+	}
+}
+
+// AddRole declares a role, it is spawned right away if the supervisor
+// has already been started.
+func (supervisor *Supervisor) AddRole(config RoleConfig) error {
+	if config.MinBackoff == 0 {
+		config.MinBackoff = IPCMSG_MIN_BACKOFF
+	}
+	if config.MaxBackoff == 0 {
+		config.MaxBackoff = IPCMSG_MAX_BACKOFF
+	}
+
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	if supervisor.stopping {
+		return ErrClosed
+	}
+	if _, exists := supervisor.roles[config.Name]; exists {
+		return fmt.Errorf("role %s declared twice", config.Name)
+	}
+	role := &supervisedRole{config: config}
+	supervisor.roles[config.Name] = role
+	if supervisor.started {
+		supervisor.wg.Add(1)
+		go supervisor.run(role)
+	}
+	return nil
+}
+
+// OnExit registers a hook called every time a process exits.
+func (supervisor *Supervisor) OnExit(hook func(role string, state *os.ProcessState)) {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	supervisor.onExit = hook
+}
+
+// Start spawns a process for every declared role.
+func (supervisor *Supervisor) Start() {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	if supervisor.started {
+		return
+	}
+	supervisor.started = true
+	for _, role := range supervisor.roles {
+		supervisor.wg.Add(1)
+		go supervisor.run(role)
+	}
+}
+
+// Channel returns the channel to the current process of a role,
+// or nil if it is being restarted.
+func (supervisor *Supervisor) Channel(name string) *Channel {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	if role, exists := supervisor.roles[name]; exists {
+		return role.channel
+	}
+	return nil
+}
+
+// Shutdown closes the channels to all processes, killing those which don't
+// exit within ShutdownTimeout, and waits for the tree to be torn down.
+func (supervisor *Supervisor) Shutdown() {
+	supervisor.shutdown(nil)
+	<-supervisor.done
+}
+
+// Done is closed once the tree has been torn down, be it by Shutdown()
+// or by the policy of a role.
+func (supervisor *Supervisor) Done() <-chan struct{} {
+	return supervisor.done
+}
+
+// Err returns why the tree was torn down by a role policy, if it was.
+func (supervisor *Supervisor) Err() error {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	return supervisor.err
+}
+
+func (supervisor *Supervisor) shutdown(err error) {
+	supervisor.mu.Lock()
+	if supervisor.stopping {
+		supervisor.mu.Unlock()
+		return
+	}
+	supervisor.stopping = true
+	supervisor.err = err
+	close(supervisor.stop)
+	channels := make([]*Channel, 0)
+	for _, role := range supervisor.roles {
+		if role.channel != nil {
+			channels = append(channels, role.channel)
+		}
+	}
+	supervisor.mu.Unlock()
+
+	// processes are expected to exit when their channel closes, those who
+	// don't get killed. the timer is armed first as a process that stopped
+	// reading holds the close of its channel up
+	timer := time.AfterFunc(supervisor.ShutdownTimeout, func() {
+		supervisor.killAll(nil)
+	})
+	for _, channel := range channels {
+		go channel.Close()
+	}
+	supervisor.wg.Wait()
+	timer.Stop()
+	close(supervisor.done)
+}
+
+// killAll kills the processes of every role but except.
+func (supervisor *Supervisor) killAll(except *supervisedRole) {
+	supervisor.mu.Lock()
+	defer supervisor.mu.Unlock()
+	for _, role := range supervisor.roles {
+		if role != except && role.cmd != nil {
+			role.killed = true
+			role.cmd.Process.Kill()
+		}
+	}
+}
+
+func (supervisor *Supervisor) spawn(role *supervisedRole) (*Cmd, *Channel, error) {
+	cmd, err := Command(role.config.Name, role.config.Args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	channel, err := cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	supervisor.mu.Lock()
+	role.cmd = cmd
+	role.channel = channel
+	stopping := supervisor.stopping
+	supervisor.mu.Unlock()
+
+	// shutdown started while we were spawning, it didn't see this one
+	if stopping {
+		channel.Close()
+		cmd.Process.Kill()
+	}
+
+	if role.config.Setup != nil {
+		role.config.Setup(channel)
+	}
+	channel.Dispatch()
+	return cmd, channel, nil
+}
+
+// run keeps a process running for role, according to its policy.
+func (supervisor *Supervisor) run(role *supervisedRole) {
+	defer supervisor.wg.Done()
+
+	backoff := role.config.MinBackoff
+	for {
+		started := time.Now()
+		cmd, channel, err := supervisor.spawn(role)
+		var state *os.ProcessState
+		var channelErr error
+		if err == nil {
+			// a process whose channel went down is of no use anymore and
+			// may not even notice, unless it's being shut down gracefully
+			select {
+			case <-cmd.exited:
+			case <-channel.Done():
+				supervisor.mu.Lock()
+				stopping := supervisor.stopping
+				supervisor.mu.Unlock()
+				if !stopping {
+					channelErr = channel.Err()
+					cmd.Process.Kill()
+				}
+			}
+			cmd.Wait()
+			channel.Close()
+			state = cmd.ProcessState
+		}
+
+		supervisor.mu.Lock()
+		role.cmd = nil
+		role.channel = nil
+		killed := role.killed
+		role.killed = false
+		stopping := supervisor.stopping
+		onExit := supervisor.onExit
+		supervisor.mu.Unlock()
+
+		if onExit != nil && state != nil {
+			onExit(role.config.Name, state)
+		}
+		if stopping {
+			return
+		}
+
+		if !killed {
+			switch role.config.Policy {
+			case IPCMSG_SHUTDOWN:
+				if err == nil && channelErr != nil {
+					err = fmt.Errorf("role %s: %v: %w", role.config.Name, channelErr, ErrRoleExited)
+				} else if err == nil {
+					err = fmt.Errorf("role %s: %v: %w", role.config.Name, state, ErrRoleExited)
+				}
+				go supervisor.shutdown(err)
+				return
+			case IPCMSG_RESTART_ALL:
+				supervisor.killAll(role)
+			}
+		}
+
+		// a process killed as part of a restart comes back right away,
+		// one that keeps exiting comes back slower and slower
+		delay := time.Duration(0)
+		if !killed {
+			if err == nil && time.Since(started) >= role.config.MaxBackoff {
+				backoff = role.config.MinBackoff
+			}
+			delay = backoff
+			backoff *= 2
+			if backoff > role.config.MaxBackoff {
+				backoff = role.config.MaxBackoff
+			}
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-supervisor.stop:
+			return
+		}
+	}
+}